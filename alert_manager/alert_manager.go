@@ -123,7 +123,6 @@ func (a *AlertManager) WaitOnStatus(desiredStatus string, id int64, checkInterva
 			time.Sleep(checkInterval)
 		}
 	}
-	return false
 }
 
 func (a *AlertManager) getToken(user, pass string) error {
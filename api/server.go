@@ -4,11 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
+	"github.com/mayuresh82/auto_remediation/executor"
 	"github.com/mayuresh82/auto_remediation/models"
 	"github.com/mayuresh82/auto_remediation/remediator"
 )
@@ -22,20 +26,34 @@ func NewServer(addr string, rem *remediator.Remediator) *Server {
 	return &Server{addr: addr, rem: rem}
 }
 
+const (
+	requestTimeout    = 10 * time.Second
+	keepAliveInterval = 15 * time.Second
+)
+
 func (s *Server) Start(ctx context.Context) {
 	router := mux.NewRouter()
-	router.HandleFunc("/api/{category}", s.Get).Methods("GET")
+	// streams are long lived so only the regular endpoints are subject to the request timeout
+	withTimeout := func(f http.HandlerFunc) http.Handler {
+		return http.TimeoutHandler(f, requestTimeout, "Request timed out")
+	}
+	router.HandleFunc("/api/remediations/{id:[0-9]+}/logs/stream", s.StreamLogs).Methods("GET")
+	router.HandleFunc("/api/commands/{id:[0-9]+}/output/{stream:stdout|stderr}", s.DownloadOutput).Methods("GET")
+	router.HandleFunc("/api/artifacts/{id:[0-9]+}/download", s.DownloadArtifact).Methods("GET")
+	router.Handle("/api/rules/{name}/effectiveness", withTimeout(s.Effectiveness)).Methods("GET")
+	router.Handle("/api/{category}", withTimeout(s.Get)).Methods("GET")
 	//router.HandleFunc("/api/auth", s.AuthAlertManager).Methods("POST")
 	//router.HandleFunc("/api/commands/run", s.RunCommand).Methods("POST")
-	router.HandleFunc("/admin/{state}", s.SetState).Methods("POST")
+	router.Handle("/api/remediations/{id:[0-9]+}/{action:approve|reject}", withTimeout(s.Approve)).Methods("POST")
+	router.Handle("/admin/{state}", withTimeout(s.SetState)).Methods("POST")
+	router.Handle("/admin/rules/{name}/enable", withTimeout(s.EnableRule)).Methods("POST")
+	router.Handle("/admin/scripts/{action}", withTimeout(s.ScriptsAction)).Methods("POST")
 
 	// set up the router
 	srv := &http.Server{
-		Handler: router,
-		Addr:    s.addr,
-		// set some sane timeouts
-		WriteTimeout: 10 * time.Second,
-		ReadTimeout:  10 * time.Second,
+		Handler:     router,
+		Addr:        s.addr,
+		ReadTimeout: requestTimeout,
 	}
 	glog.Infof("Starting API server on %s", s.addr)
 	srv.ListenAndServe()
@@ -43,10 +61,15 @@ func (s *Server) Start(ctx context.Context) {
 
 func (s *Server) Get(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
-	if vars["category"] == "rules" {
+	switch vars["category"] {
+	case "rules":
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(s.rem.Config.Rules)
 		return
+	case "scripts":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"bundle_version": s.rem.ScriptsVersion()})
+		return
 	}
 	params := make(map[string]interface{})
 	for q, v := range req.URL.Query() {
@@ -68,18 +91,73 @@ func (s *Server) Get(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(items)
 }
 
-func (s *Server) SetState(w http.ResponseWriter, req *http.Request) {
+// Effectiveness serves the share of the verified remediations of a rule that were effective
+func (s *Server) Effectiveness(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if _, ok := s.rem.Config.RuleByName(name); !ok {
+		http.Error(w, fmt.Sprintf("Rule %s not found", name), http.StatusNotFound)
+		return
+	}
+	e, err := s.rem.Db.Effectiveness(name)
+	if err != nil {
+		glog.Errorf("Failed to query effectiveness of rule %s: %v", name, err)
+		http.Error(w, fmt.Sprintf("Failed to query effectiveness: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// authorized checks the request for the admin credentials, returning false if it fails
+func (s *Server) authorized(w http.ResponseWriter, req *http.Request) bool {
 	user, pass, ok := req.BasicAuth()
 	if !ok {
 		http.Error(w, "Missing username/password", http.StatusBadRequest)
-		return
+		return false
 	}
 	adminUser, adminPass := s.rem.Config.AdminCreds()
-	if user != adminUser && pass != adminPass {
+	if user != adminUser || pass != adminPass {
+		http.Error(w, "Authentication Failed", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Approve approves or rejects a remediation that is waiting for approval, on behalf of
+// the approver the request is authenticated as
+func (s *Server) Approve(w http.ResponseWriter, req *http.Request) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		http.Error(w, "Missing username/password", http.StatusBadRequest)
+		return
+	}
+	if !s.rem.Config.IsApprover(user, pass) {
 		http.Error(w, "Authentication Failed", http.StatusUnauthorized)
 		return
 	}
 	vars := mux.Vars(req)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid remediation id: %v", err), http.StatusBadRequest)
+		return
+	}
+	approved := vars["action"] == "approve"
+	if err := s.rem.Approve(id, user, approved); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to %s: %v", vars["action"], err), http.StatusConflict)
+		return
+	}
+	outcome := "rejected"
+	if approved {
+		outcome = "approved"
+	}
+	fmt.Fprintf(w, "Remediation %d %s by %s\n", id, outcome, user)
+}
+
+func (s *Server) SetState(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(w, req) {
+		return
+	}
+	vars := mux.Vars(req)
 	var err error
 	switch vars["state"] {
 	case "enable":
@@ -95,3 +173,163 @@ func (s *Server) SetState(w http.ResponseWriter, req *http.Request) {
 	}
 	fmt.Fprintf(w, "System is now %sd\n", vars["state"])
 }
+
+// EnableRule re-enables a rule that was paused after an incident storm
+func (s *Server) EnableRule(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(w, req) {
+		return
+	}
+	name := mux.Vars(req)["name"]
+	if _, ok := s.rem.Config.RuleByName(name); !ok {
+		http.Error(w, fmt.Sprintf("Rule %s not found", name), http.StatusNotFound)
+		return
+	}
+	if err := s.rem.EnableRule(name); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to enable rule: %v", err), http.StatusConflict)
+		return
+	}
+	fmt.Fprintf(w, "Rule %s is now enabled\n", name)
+}
+
+// ScriptsAction rolls back to the previous scripts bundle or resumes scripts updates
+func (s *Server) ScriptsAction(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(w, req) {
+		return
+	}
+	var err error
+	switch mux.Vars(req)["action"] {
+	case "rollback":
+		err = s.rem.RollbackScripts()
+	case "resume":
+		err = s.rem.ResumeScripts()
+	default:
+		http.Error(w, "Invalid request, choose either 'rollback' or 'resume'", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to %s scripts: %v", mux.Vars(req)["action"], err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Scripts %s done\n", mux.Vars(req)["action"])
+}
+
+// DownloadOutput serves the full stdout or stderr of a command, including output that
+// was truncated when it was stored.
+func (s *Server) DownloadOutput(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid command id: %v", err), http.StatusBadRequest)
+		return
+	}
+	items, err := s.rem.Db.Query("commands", map[string]interface{}{"id": id})
+	if err != nil {
+		glog.Errorf("Failed to query command %d: %v", id, err)
+		http.Error(w, fmt.Sprintf("Failed to query command: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, fmt.Sprintf("Command %d not found", id), http.StatusNotFound)
+		return
+	}
+	cmd := items[0].(*models.Command)
+	output, artifact := cmd.Results, cmd.StdoutArtifact
+	if vars["stream"] == "stderr" {
+		output, artifact = cmd.Logs, cmd.StderrArtifact
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=command-%d-%s.log", id, vars["stream"]))
+	if artifact == "" {
+		io.WriteString(w, output)
+		return
+	}
+	f, err := s.rem.Artifacts.Open(artifact)
+	if err != nil {
+		glog.Errorf("Failed to open artifact %s: %v", artifact, err)
+		http.Error(w, fmt.Sprintf("Failed to open output: %v", err), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	io.Copy(w, f)
+}
+
+// DownloadArtifact serves a file produced by a command
+func (s *Server) DownloadArtifact(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid artifact id: %v", err), http.StatusBadRequest)
+		return
+	}
+	items, err := s.rem.Db.Query("artifacts", map[string]interface{}{"id": id})
+	if err != nil {
+		glog.Errorf("Failed to query artifact %d: %v", id, err)
+		http.Error(w, fmt.Sprintf("Failed to query artifact: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, fmt.Sprintf("Artifact %d not found", id), http.StatusNotFound)
+		return
+	}
+	artifact := items[0].(*models.Artifact)
+	f, err := s.rem.Artifacts.Open(artifact.Path)
+	if err != nil {
+		glog.Errorf("Failed to open artifact %s: %v", artifact.Path, err)
+		http.Error(w, fmt.Sprintf("Failed to open artifact: %v", err), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(artifact.Name)))
+	http.ServeContent(w, req, artifact.Name, time.Time{}, f)
+}
+
+// StreamLogs streams the output of the commands of a running remediation as Server-Sent Events.
+// Lines buffered so far are sent first, followed by new lines as they are produced. An `end`
+// event is sent once the remediation run has finished.
+func (s *Server) StreamLogs(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid remediation id: %v", err), http.StatusBadRequest)
+		return
+	}
+	buf, ok := s.rem.Logs(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No logs found for remediation %d", id), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	backlog, lines, cancel := buf.Subscribe()
+	defer cancel()
+	send := func(line executor.LogLine) {
+		data, _ := json.Marshal(&line)
+		fmt.Fprintf(w, "event: log\ndata: %s\n\n", data)
+	}
+	for _, line := range backlog {
+		send(line)
+	}
+	flusher.Flush()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				fmt.Fprint(w, "event: end\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			send(line)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
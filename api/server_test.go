@@ -3,11 +3,17 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mayuresh82/auto_remediation/executor"
 	"github.com/mayuresh82/auto_remediation/models"
 	"github.com/mayuresh82/auto_remediation/remediator"
 	"github.com/stretchr/testify/assert"
@@ -25,6 +31,10 @@ func (m *MockDB) Query(table string, params map[string]interface{}) ([]interface
 	return nil, fmt.Errorf("Nothing found")
 }
 
+func (m *MockDB) Effectiveness(rule string) (*models.Effectiveness, error) {
+	return &models.Effectiveness{Rule: rule, Verified: 3, Ineffective: 1, Rate: 0.75}, nil
+}
+
 func TestServerGet(t *testing.T) {
 	db := &MockDB{}
 	r := &remediator.Remediator{
@@ -76,3 +86,204 @@ func TestServerGet(t *testing.T) {
 	assert.Equal(t, len(rem), 1)
 	assert.Equal(t, rem[0].Id, int64(99))
 }
+
+func TestServerEffectiveness(t *testing.T) {
+	r := &remediator.Remediator{
+		Config: &remediator.ConfigHandler{Rules: []remediator.Rule{
+			remediator.Rule{AlertName: "BB Link Errors"},
+		}},
+		Db: &MockDB{},
+	}
+	s := &Server{rem: r}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/rules/{name}/effectiveness", s.Effectiveness).Methods("GET")
+
+	req, _ := http.NewRequest("GET", "/api/rules/Unknown/effectiveness", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+
+	req, _ = http.NewRequest("GET", "/api/rules/BB%20Link%20Errors/effectiveness", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	e := &models.Effectiveness{}
+	if err := json.NewDecoder(rr.Result().Body).Decode(e); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, e.Rule, "BB Link Errors")
+	assert.Equal(t, e.Rate, 0.75)
+}
+
+func TestServerApprove(t *testing.T) {
+	c := &remediator.ConfigHandler{}
+	c.Config.AdminUser, c.Config.AdminPass = "admin", "foo"
+	c.Config.Approvers = map[string]string{"alice": "bar"}
+	s := &Server{rem: &remediator.Remediator{Config: c}}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/remediations/{id:[0-9]+}/{action:approve|reject}", s.Approve).Methods("POST")
+
+	req, _ := http.NewRequest("POST", "/api/remediations/5/approve", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+
+	req.SetBasicAuth("alice", "foo")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+
+	// the remediation is not waiting for approval
+	req.SetBasicAuth("alice", "bar")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusConflict)
+	assert.Contains(t, rr.Body.String(), "Remediation 5 is not waiting for approval")
+}
+
+func TestServerAdminAuth(t *testing.T) {
+	c := &remediator.ConfigHandler{}
+	c.Config.AdminUser, c.Config.AdminPass = "admin", "foo"
+	s := &Server{rem: &remediator.Remediator{Config: c}}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/{state}", s.SetState).Methods("POST")
+
+	// both the user and the password have to match
+	for _, creds := range [][2]string{{"admin", "bar"}, {"alice", "foo"}, {"alice", "bar"}} {
+		req, _ := http.NewRequest("POST", "/admin/disable", nil)
+		req.SetBasicAuth(creds[0], creds[1])
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, rr.Code, http.StatusUnauthorized, creds[0]+":"+creds[1])
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/restart", nil)
+	req.SetBasicAuth("admin", "foo")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusInternalServerError)
+	assert.Contains(t, rr.Body.String(), "choose either 'enable' or 'disable'")
+}
+
+func TestServerEnableRule(t *testing.T) {
+	c := &remediator.ConfigHandler{Rules: []remediator.Rule{{AlertName: "Test1"}}}
+	c.Config.AdminUser, c.Config.AdminPass = "admin", "foo"
+	s := &Server{rem: &remediator.Remediator{Config: c}}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/rules/{name}/enable", s.EnableRule).Methods("POST")
+
+	req, _ := http.NewRequest("POST", "/admin/rules/Test1/enable", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+
+	req.SetBasicAuth("admin", "foo")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusConflict)
+	assert.Contains(t, rr.Body.String(), "Rule Test1 is not paused")
+
+	req, _ = http.NewRequest("POST", "/admin/rules/Test2/enable", nil)
+	req.SetBasicAuth("admin", "foo")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+}
+
+func TestServerStreamLogs(t *testing.T) {
+	r := &remediator.Remediator{}
+	s := &Server{rem: r}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/remediations/{id:[0-9]+}/logs/stream", s.StreamLogs).Methods("GET")
+
+	req, _ := http.NewRequest("GET", "/api/remediations/5/logs/stream", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+
+	buf := r.LogBuffer(5)
+	buf.Add(executor.LogLine{Command: "Drain Link", Stream: "stderr", Line: "draining xe-0/0/0"})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		buf.Add(executor.LogLine{Command: "Drain Link", Stream: "stderr", Line: "drained"})
+		buf.Close()
+	}()
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Header().Get("Content-Type"), "text/event-stream")
+	body := rr.Body.String()
+	assert.Contains(t, body, `"line":"draining xe-0/0/0"`)
+	assert.Contains(t, body, `"line":"drained"`)
+	assert.True(t, strings.HasSuffix(body, "event: end\ndata: {}\n\n"))
+}
+
+func TestServerDownloadOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := executor.NewArtifactStore(dir)
+	f, path, err := store.Create("Dump Config", "stdout.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("full output")
+	f.Close()
+	db := &MockDB{}
+	r := &remediator.Remediator{Db: db, Artifacts: store}
+	s := &Server{rem: r}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/commands/{id:[0-9]+}/output/{stream:stdout|stderr}", s.DownloadOutput).Methods("GET")
+
+	db.query = func() ([]interface{}, error) { return nil, nil }
+	req, _ := http.NewRequest("GET", "/api/commands/3/output/stdout", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+
+	db.query = func() ([]interface{}, error) {
+		return []interface{}{&models.Command{Id: 3, Results: "truncated", StdoutArtifact: path, Logs: "logs"}}, nil
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Body.String(), "full output")
+
+	req, _ = http.NewRequest("GET", "/api/commands/3/output/stderr", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Body.String(), "logs")
+}
+
+func TestServerDownloadArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "cmd", "diffs"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "cmd", "diffs", "config.diff"), []byte("+mtu 9000\n"), 0644)
+	db := &MockDB{}
+	r := &remediator.Remediator{Db: db, Artifacts: executor.NewArtifactStore(dir)}
+	s := &Server{rem: r}
+	router := mux.NewRouter()
+	router.HandleFunc("/api/artifacts/{id:[0-9]+}/download", s.DownloadArtifact).Methods("GET")
+
+	db.query = func() ([]interface{}, error) { return nil, nil }
+	req, _ := http.NewRequest("GET", "/api/artifacts/7/download", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+
+	db.query = func() ([]interface{}, error) {
+		return []interface{}{&models.Artifact{Id: 7, Name: "diffs/config.diff", Path: "cmd/diffs/config.diff"}}, nil
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Body.String(), "+mtu 9000\n")
+	assert.Equal(t, rr.Header().Get("Content-Disposition"), `attachment; filename="config.diff"`)
+}
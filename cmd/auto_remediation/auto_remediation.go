@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/mayuresh82/auto_remediation/api"
 	"github.com/mayuresh82/auto_remediation/remediator"
+	"github.com/mayuresh82/auto_remediation/secrets"
 )
 
 var (
@@ -21,6 +23,8 @@ var (
 	pprofAddr   = flag.String("pprof-addr", "", "pprof address to listen on, dont activate pprof if empty")
 	config      = flag.String("config", "", "Config file")
 	fVersion    = flag.Bool("version", false, "display the version")
+	encrypt     = flag.String("encrypt-secrets", "", "Encrypt this YAML file of secrets for the file secret provider and print it")
+	keyFile     = flag.String("secrets-key-file", "", "Key file to encrypt secrets with")
 	nextVersion = "0.0.1"
 	version     string
 	commit      string
@@ -38,6 +42,32 @@ func getVersion() string {
 	return fmt.Sprintf("%s~%s", version, commit)
 }
 
+// runWorker runs the worker subcommand: auto_remediation -config <file> worker -region <region>
+func runWorker(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	region := fs.String("region", "", "Region of the commands to run")
+	concurrency := fs.Int("concurrency", 4, "Number of commands to run at a time")
+	fs.Parse(args)
+	if *config == "" || *region == "" {
+		glog.Exit("A config file and region must be specified with -config and -region")
+	}
+	worker, err := remediator.NewWorker(*config, *region, *concurrency)
+	if err != nil {
+		glog.Exitf("Failed to start worker: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		glog.Infof("Waiting for running commands to finish..")
+		cancel()
+	}()
+	if err := worker.Run(ctx); err != nil {
+		glog.Exitf("Worker failed: %v", err)
+	}
+}
+
 func main() {
 	if *pprofAddr != "" {
 		go func() {
@@ -59,6 +89,26 @@ func main() {
 		fmt.Printf("Auto Remediator: %s , (git: %s, %s)\n", getVersion(), commit, branch)
 		os.Exit(0)
 	}
+	if *encrypt != "" {
+		key, err := secrets.LoadKey(*keyFile)
+		if err != nil {
+			glog.Exitf("Failed to load key: %v", err)
+		}
+		plain, err := ioutil.ReadFile(*encrypt)
+		if err != nil {
+			glog.Exitf("Failed to read secrets: %v", err)
+		}
+		data, err := secrets.Encrypt(plain, key)
+		if err != nil {
+			glog.Exitf("Failed to encrypt secrets: %v", err)
+		}
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "worker" {
+		runWorker(flag.Args()[1:])
+		return
+	}
 	if *config == "" {
 		glog.Exit("A config file must be specified with -config")
 	}
@@ -2,6 +2,7 @@ package escalate
 
 import (
 	"fmt"
+	"io"
 	"sort"
 	"time"
 
@@ -40,6 +41,8 @@ type TaskEscalator interface {
 	CreateTask(task *Task) error
 	UpdateTask(task *Task) error
 	LoadTask(task *Task) error
+	// AttachFile attaches the contents of r to the task as the file name
+	AttachFile(task *Task, name string, r io.Reader) error
 }
 
 type jiraClienter interface {
@@ -47,6 +50,7 @@ type jiraClienter interface {
 	Create(*jira.Issue) (*jira.Issue, error)
 	GetIssue(string) (*jira.Issue, error)
 	UpdateIssue(string, map[string]interface{}) error
+	PostAttachment(string, io.Reader, string) error
 }
 
 type jiraClient struct {
@@ -76,6 +80,11 @@ func (c *jiraClient) UpdateIssue(issueKey string, data map[string]interface{}) e
 	return err
 }
 
+func (c *jiraClient) PostAttachment(issueKey string, r io.Reader, name string) error {
+	_, _, err := c.Client.Issue.PostAttachment(issueKey, r, name)
+	return err
+}
+
 var closedJiraStates = []string{"Closed", "Done"}
 
 func in(elem string, list []string) bool {
@@ -178,3 +187,10 @@ func (j *JiraEscalator) LoadTask(task *Task) error {
 	task.Created = time.Time(issue.Fields.Created)
 	return nil
 }
+
+func (j *JiraEscalator) AttachFile(task *Task, name string, r io.Reader) error {
+	if task.ID == "" {
+		return fmt.Errorf("AttachFile requires a task ID")
+	}
+	return j.client.PostAttachment(task.ID, r, name)
+}
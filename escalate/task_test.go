@@ -1,6 +1,9 @@
 package escalate
 
 import (
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,7 +11,8 @@ import (
 )
 
 type mockJiraClient struct {
-	comments []string
+	comments    []string
+	attachments map[string]string
 }
 
 func (c *mockJiraClient) AddComment(taskID string, comment *jira.Comment) error {
@@ -34,6 +38,18 @@ func (c *mockJiraClient) UpdateIssue(issueKey string, data map[string]interface{
 	return nil
 }
 
+func (c *mockJiraClient) PostAttachment(issueKey string, r io.Reader, name string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if c.attachments == nil {
+		c.attachments = make(map[string]string)
+	}
+	c.attachments[name] = string(data)
+	return nil
+}
+
 func TestJiraCreate(t *testing.T) {
 	client := &mockJiraClient{}
 	esc := &JiraEscalator{project: "PROJ-1", client: client}
@@ -46,6 +62,10 @@ func TestJiraCreate(t *testing.T) {
 	task.Params["comment"] = "This comment"
 	err = esc.UpdateTask(task)
 	assert.Equal(t, client.comments[0], "This comment")
+
+	assert.Nil(t, esc.AttachFile(task, "show.txt", strings.NewReader("show output")))
+	assert.Equal(t, client.attachments["show.txt"], "show output")
+	assert.Error(t, esc.AttachFile(&Task{}, "show.txt", strings.NewReader("")))
 }
 
 func TestLoadTasks(t *testing.T) {
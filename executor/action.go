@@ -0,0 +1,187 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CmdTypeScript = "script"
+	CmdTypeGo     = "go"
+)
+
+// Action is a step implemented in Go that is run in-process by the executor instead of
+// shelling out to the runner. Actions report failures through the returned Result and
+// only return an error if they could not be run at all.
+type Action interface {
+	Run(ctx context.Context, cmd *Command) (*Result, error)
+}
+
+// ActionFunc adapts a function to the Action interface
+type ActionFunc func(ctx context.Context, cmd *Command) (*Result, error)
+
+func (f ActionFunc) Run(ctx context.Context, cmd *Command) (*Result, error) {
+	return f(ctx, cmd)
+}
+
+var (
+	actionsMu sync.RWMutex
+	actions   = make(map[string]Action)
+)
+
+// RegisterAction makes an action available to rules as a `type: go` command with the given name.
+// Registering an existing name replaces the action.
+func RegisterAction(name string, a Action) {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	actions[name] = a
+}
+
+func lookupAction(name string) (Action, bool) {
+	actionsMu.RLock()
+	defer actionsMu.RUnlock()
+	a, ok := actions[name]
+	return a, ok
+}
+
+func init() {
+	RegisterAction("wait", ActionFunc(waitAction))
+	RegisterAction("http", &httpAction{client: &http.Client{}})
+}
+
+// ParseArgs parses command args of the form `--key value` or `--key=value` into a map.
+// Flags without a value are set to "true".
+func ParseArgs(args []string) map[string]string {
+	ret := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			continue
+		}
+		key := strings.TrimPrefix(args[i], "--")
+		if parts := strings.SplitN(key, "=", 2); len(parts) == 2 {
+			ret[parts[0]] = parts[1]
+			continue
+		}
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			ret[key] = args[i+1]
+			i++
+			continue
+		}
+		ret[key] = "true"
+	}
+	return ret
+}
+
+func passed(p bool) *bool {
+	return &p
+}
+
+func runAction(ctx context.Context, cmd *Command) *CmdResult {
+	res := &CmdResult{Command: cmd}
+	a, ok := lookupAction(cmd.Command)
+	if !ok {
+		res.Failure = FailureNotFound
+		res.Error = fmt.Errorf("Unknown action: %s", cmd.Command)
+		return res
+	}
+	type output struct {
+		result *Result
+		err    error
+	}
+	done := make(chan output, 1)
+	res.StartTime = time.Now()
+	go func() {
+		r, err := a.Run(ctx, cmd)
+		done <- output{r, err}
+	}()
+	select {
+	case out := <-done:
+		res.Result, res.Error = out.result, out.err
+	case <-ctx.Done():
+		res.Failure = FailureCancelled
+		if ctx.Err() == context.DeadlineExceeded {
+			res.Failure = FailureTimeout
+		}
+		res.Error = fmt.Errorf("Action %s did not finish: %v", cmd.Command, ctx.Err())
+	}
+	res.EndTime = time.Now()
+	res.Runtime = res.EndTime.Sub(res.StartTime)
+	if res.Result != nil {
+		if res.Result.Version == 0 {
+			res.Result.Version = ResultVersion
+		}
+		if data, err := json.Marshal(res.Result); err == nil {
+			res.Stdout = string(data)
+		}
+	}
+	res.classify()
+	return res
+}
+
+// waitAction sleeps for the given --duration
+func waitAction(ctx context.Context, cmd *Command) (*Result, error) {
+	d, err := time.ParseDuration(ParseArgs(cmd.Args)["duration"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid duration: %v", err)
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &Result{Passed: passed(true), Message: fmt.Sprintf("Waited for %v", d)}, nil
+}
+
+// httpAction calls an HTTP API with --method (default GET), --url and an optional --body.
+// It passes if the response code matches --expect_status, or is a 2xx if unset.
+type httpAction struct {
+	client *http.Client
+}
+
+func (h *httpAction) Run(ctx context.Context, cmd *Command) (*Result, error) {
+	args := ParseArgs(cmd.Args)
+	method := args["method"]
+	if method == "" {
+		method = "GET"
+	}
+	if args["url"] == "" {
+		return nil, fmt.Errorf("Missing --url")
+	}
+	req, err := http.NewRequest(method, args["url"], bytes.NewBufferString(args["body"]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid request: %v", err)
+	}
+	if args["body"] != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return &Result{Passed: passed(false), Message: fmt.Sprintf("Request failed: %v", err)}, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if expect, found := args["expect_status"]; found {
+		ok = expect == strconv.Itoa(resp.StatusCode)
+	}
+	data := map[string]interface{}{"status_code": resp.StatusCode}
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err == nil {
+		data["body"] = decoded
+	} else {
+		data["body"] = string(body)
+	}
+	return &Result{
+		Passed:  passed(ok),
+		Message: fmt.Sprintf("%s %s returned %s", method, args["url"], resp.Status),
+		Data:    data,
+	}, nil
+}
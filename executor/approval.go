@@ -0,0 +1,32 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ApprovalFunc blocks until a human approves cmd to run, returning an error if it was
+// rejected or not approved in time
+type ApprovalFunc func(ctx context.Context, cmd *Command) error
+
+// withApproval wraps run so that commands that require approval only run once their
+// Approval func allows them to. Commands in dry run mode dont change anything and are
+// run without approval.
+func withApproval(run runFunc) runFunc {
+	return func(ctx context.Context, cmd *Command) *CmdResult {
+		if !cmd.RequireApproval || cmd.DryRun {
+			return run(ctx, cmd)
+		}
+		if cmd.Approval == nil {
+			return failedResult(cmd, FailureRejected, fmt.Errorf("Cmd %s requires approval but cannot be approved", cmd.Name))
+		}
+		start := time.Now()
+		if err := cmd.Approval(ctx, cmd); err != nil {
+			res := failedResult(cmd, FailureRejected, err)
+			res.StartTime, res.EndTime = start, time.Now()
+			return res
+		}
+		return run(ctx, cmd)
+	}
+}
@@ -0,0 +1,134 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ArtifactsDirEnv is the env var that points script commands at the dir to write their artifacts to
+const ArtifactsDirEnv = "AR_ARTIFACTS_DIR"
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// Artifact is a file produced by a command
+type Artifact struct {
+	// Name is the path of the file relative to the artifacts dir of the command
+	Name string
+	// Path is the path of the file in the artifact store
+	Path string
+	Size int64
+}
+
+// ArtifactStore keeps files produced by commands on disk. Artifacts are referred to by
+// their path relative to the store.
+type ArtifactStore struct {
+	dir string
+}
+
+func NewArtifactStore(dir string) *ArtifactStore {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "auto_remediation", "artifacts")
+	}
+	return &ArtifactStore{dir: dir}
+}
+
+func (s *ArtifactStore) name(cmd, name string) string {
+	now := time.Now()
+	return filepath.Join(
+		now.Format("2006-01-02"),
+		fmt.Sprintf("%d-%s-%s", now.UnixNano(), unsafeChars.ReplaceAllString(cmd, "_"), unsafeChars.ReplaceAllString(name, "_")),
+	)
+}
+
+// CreateDir creates a dir for the command named cmd to write artifacts to and returns
+// its full path along with its path in the store
+func (s *ArtifactStore) CreateDir(cmd string) (string, string, error) {
+	rel := s.name(cmd, "files")
+	full := filepath.Join(s.dir, rel)
+	if err := os.MkdirAll(full, 0755); err != nil {
+		return "", "", fmt.Errorf("Failed to create artifacts dir: %v", err)
+	}
+	return full, rel, nil
+}
+
+// Collect returns the files written to the artifacts dir at path rel in the store. The
+// dir is removed if it is empty.
+func (s *ArtifactStore) Collect(rel string) ([]Artifact, error) {
+	dir, err := s.Path(rel)
+	if err != nil {
+		return nil, err
+	}
+	var artifacts []Artifact
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, Artifact{Name: name, Path: filepath.Join(rel, name), Size: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to collect artifacts: %v", err)
+	}
+	if len(artifacts) == 0 {
+		os.RemoveAll(dir)
+	}
+	return artifacts, nil
+}
+
+// Create creates a new artifact for the command named cmd and returns it along with
+// its path in the store
+func (s *ArtifactStore) Create(cmd, name string) (*os.File, string, error) {
+	rel := s.name(cmd, name)
+	full := filepath.Join(s.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return nil, "", fmt.Errorf("Failed to create artifacts dir: %v", err)
+	}
+	f, err := os.Create(full)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to create artifact: %v", err)
+	}
+	return f, rel, nil
+}
+
+// Write writes data to the artifact at path rel in the store, e.g. an artifact that a
+// remote worker created at that path in its store
+func (s *ArtifactStore) Write(rel string, data []byte) error {
+	full, err := s.Path(rel)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return fmt.Errorf("Failed to create artifacts dir: %v", err)
+	}
+	return ioutil.WriteFile(full, data, 0644)
+}
+
+// Path returns the full path of the artifact at path rel in the store
+func (s *ArtifactStore) Path(rel string) (string, error) {
+	full := filepath.Join(s.dir, filepath.Clean("/"+rel))
+	if !strings.HasPrefix(full, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid artifact path: %s", rel)
+	}
+	return full, nil
+}
+
+// Open opens the artifact at path rel in the store
+func (s *ArtifactStore) Open(rel string) (*os.File, error) {
+	full, err := s.Path(rel)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(full)
+}
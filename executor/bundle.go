@@ -0,0 +1,446 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	getter "github.com/hashicorp/go-getter"
+)
+
+const (
+	defaultKeepBundles     = 3
+	defaultFetchInterval   = 5 * time.Minute
+	bundleValidateTimeout  = 2 * time.Minute
+	stagingPrefix          = ".staging-"
+	bundleLinkTmpExtension = ".tmp"
+	// file next to each bundle that records its version
+	versionFile = "VERSION"
+)
+
+// BundleManager is implemented by executioners that manage versions of the scripts bundle
+type BundleManager interface {
+	// Rollback activates the bundle that was active before the current one and pauses
+	// automatic updates until Resume is called
+	Rollback() error
+	Resume() error
+	// BundleVersion returns the version of the active bundle
+	BundleVersion() string
+}
+
+// bundles manages the versions of the scripts bundle. Every fetch is downloaded into a
+// staging dir and validated before it is activated by atomically swapping the scripts
+// path symlink over to it, so that commands never see a partially updated bundle.
+// The previous bundles are kept around for rollback.
+//
+// Each bundle lives in <dir>/<id>/<name>, where name is the base name of the scripts path
+// so that the runner can keep importing the scripts under the same package name.
+type bundles struct {
+	link     string
+	dir      string
+	name     string
+	url      string
+	keep     int
+	validate []string
+	inUse    map[string]int
+	paused   bool
+	sync.Mutex
+}
+
+func newBundles(opts Options) *bundles {
+	b := &bundles{
+		link:     filepath.Clean(opts.ScriptsPath),
+		dir:      opts.BundlesDir,
+		url:      opts.ScriptsURL,
+		keep:     opts.KeepBundles,
+		validate: opts.ValidateCmd,
+		inUse:    make(map[string]int),
+	}
+	b.name = filepath.Base(b.link)
+	if b.dir == "" {
+		b.dir = filepath.Join(filepath.Dir(b.link), "."+b.name+".bundles")
+	}
+	if b.keep <= 0 {
+		b.keep = defaultKeepBundles
+	}
+	return b
+}
+
+// current returns the id of the active bundle, or "" if there is none
+func (b *bundles) current() string {
+	target, err := os.Readlink(b.link)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(target))
+}
+
+func (b *bundles) path(id string) string {
+	return filepath.Join(b.dir, id, b.name)
+}
+
+// version returns the version of bundle id, or "" if it is unknown
+func (b *bundles) version(id string) string {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, id, versionFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// BundleVersion returns the version of the active bundle
+func (b *bundles) BundleVersion() string {
+	return b.version(b.current())
+}
+
+// find returns the id of the newest bundle with the given version
+func (b *bundles) find(version string) (string, error) {
+	ids, err := b.list()
+	if err != nil {
+		return "", fmt.Errorf("Failed to list bundles: %v", err)
+	}
+	for _, id := range ids {
+		if b.version(id) == version {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("Scripts bundle version %s is not available", version)
+}
+
+// list returns the ids of all bundles, newest first
+func (b *bundles) list() ([]string, error) {
+	entries, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name()[0] != '.' {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+// migrate turns a scripts path that is a plain directory, as fetched before scripts were
+// managed as bundles, into the first bundle and links the scripts path to it
+func (b *bundles) migrate() error {
+	fi, err := os.Lstat(b.link)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("Scripts path %s exists and is not a directory or symlink", b.link)
+	}
+	version, err := bundleVersion(b.link)
+	if err != nil {
+		return fmt.Errorf("Failed to compute version of scripts in %s: %v", b.link, err)
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.MkdirAll(filepath.Join(b.dir, id), 0755); err != nil {
+		return fmt.Errorf("Failed to create bundles dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(b.dir, id, versionFile), []byte(version+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write bundle version: %v", err)
+	}
+	if err := os.Rename(b.link, b.path(id)); err != nil {
+		os.RemoveAll(filepath.Join(b.dir, id))
+		return fmt.Errorf("Failed to migrate scripts path %s to a bundle, move it into %s and replace it with a symlink to it: %v",
+			b.link, b.path(id), err)
+	}
+	if err := b.activate(id); err != nil {
+		return err
+	}
+	glog.Infof("Migrated scripts in %s to bundle %s, version %s", b.link, id, version)
+	return nil
+}
+
+// update fetches, validates and activates a new bundle
+func (b *bundles) update() error {
+	if err := b.migrate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return fmt.Errorf("Failed to create bundles dir: %v", err)
+	}
+	staging, err := ioutil.TempDir(b.dir, stagingPrefix)
+	if err != nil {
+		return fmt.Errorf("Failed to create staging dir: %v", err)
+	}
+	defer os.RemoveAll(staging)
+	// commands may run as other users
+	if err := os.Chmod(staging, 0755); err != nil {
+		return fmt.Errorf("Failed to create staging dir: %v", err)
+	}
+	fetched := filepath.Join(staging, "fetched")
+	if err := getter.GetAny(fetched, b.url); err != nil {
+		return fmt.Errorf("Failed to fetch scripts: %v", err)
+	}
+	dst := filepath.Join(staging, b.name)
+	// local directories are fetched as a symlink to the source, snapshot them instead
+	if fi, err := os.Lstat(fetched); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		src, err := filepath.EvalSymlinks(fetched)
+		if err != nil {
+			return err
+		}
+		if err := copyDir(src, dst); err != nil {
+			return fmt.Errorf("Failed to copy scripts: %v", err)
+		}
+		os.Remove(fetched)
+	} else if err := os.Rename(fetched, dst); err != nil {
+		return err
+	}
+	version, err := bundleVersion(dst)
+	if err != nil {
+		return fmt.Errorf("Failed to compute bundle version: %v", err)
+	}
+	if current := b.current(); current != "" && b.version(current) == version {
+		glog.V(2).Infof("Scripts bundle %s is unchanged at version %s", current, version)
+		return nil
+	}
+	if err := b.check(dst); err != nil {
+		return fmt.Errorf("Refusing invalid scripts bundle: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, versionFile), []byte(version+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write bundle version: %v", err)
+	}
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.Rename(staging, filepath.Join(b.dir, id)); err != nil {
+		return fmt.Errorf("Failed to store bundle: %v", err)
+	}
+	if err := b.activate(id); err != nil {
+		return err
+	}
+	glog.Infof("Activated scripts bundle %s, version %s", id, version)
+	b.prune()
+	return nil
+}
+
+// check validates a staged bundle by making sure the runner exists and running the validation hook
+func (b *bundles) check(path string) error {
+	if _, err := os.Stat(filepath.Join(path, runnerCmd)); err != nil {
+		return fmt.Errorf("Missing runner: %v", err)
+	}
+	if len(b.validate) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bundleValidateTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, b.validate[0], b.validate[1:]...)
+	cmd.Dir = path
+	cmd.Env = append(os.Environ(), "BUNDLE_PATH="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Validation failed: %v: %s", err, out)
+	}
+	return nil
+}
+
+// activate atomically points the scripts path at bundle id
+func (b *bundles) activate(id string) error {
+	tmp := b.link + bundleLinkTmpExtension
+	os.Remove(tmp)
+	if err := os.Symlink(b.path(id), tmp); err != nil {
+		return fmt.Errorf("Failed to link bundle: %v", err)
+	}
+	if err := os.Rename(tmp, b.link); err != nil {
+		return fmt.Errorf("Failed to activate bundle: %v", err)
+	}
+	return nil
+}
+
+// prune removes all but the newest b.keep bundles, skipping the active bundle and
+// bundles that commands are still running from
+func (b *bundles) prune() {
+	ids, err := b.list()
+	if err != nil {
+		glog.Errorf("Failed to list bundles: %v", err)
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	current := b.current()
+	for i, id := range ids {
+		if i < b.keep || id == current || b.inUse[id] > 0 {
+			continue
+		}
+		glog.V(2).Infof("Removing old scripts bundle %s", id)
+		if err := os.RemoveAll(filepath.Join(b.dir, id)); err != nil {
+			glog.Errorf("Failed to remove bundle %s: %v", id, err)
+		}
+	}
+}
+
+// acquire returns the path and version of the active bundle, or of the bundle with the
+// given version if set, and marks it as in use until release is called. The bundle is
+// resolved under the lock so that it cannot be pruned before it is marked in use.
+func (b *bundles) acquire(version string) (string, string, func(), error) {
+	b.Lock()
+	defer b.Unlock()
+	id := b.current()
+	if version != "" {
+		var err error
+		if id, err = b.find(version); err != nil {
+			return "", "", nil, err
+		}
+	}
+	b.inUse[id]++
+	release := func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.inUse[id]--; b.inUse[id] <= 0 {
+			delete(b.inUse, id)
+		}
+	}
+	return b.path(id), b.version(id), release, nil
+}
+
+// Paused returns true if automatic updates are paused
+func (b *bundles) Paused() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.paused
+}
+
+// Resume resumes automatic updates after a rollback
+func (b *bundles) Resume() error {
+	b.Lock()
+	defer b.Unlock()
+	b.paused = false
+	return nil
+}
+
+// Rollback activates the newest bundle older than the active one
+func (b *bundles) Rollback() error {
+	ids, err := b.list()
+	if err != nil {
+		return fmt.Errorf("Failed to list bundles: %v", err)
+	}
+	current := b.current()
+	for _, id := range ids {
+		if id < current {
+			if err := b.activate(id); err != nil {
+				return err
+			}
+			glog.Infof("Rolled back scripts bundle %s to %s, pausing updates", current, id)
+			b.Lock()
+			b.paused = true
+			b.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("No bundle older than %s to roll back to", current)
+}
+
+// bundleVersion returns the version of the bundle at path: the git revision it was
+// checked out at if it is a git repo, or else a hash of its contents.
+func bundleVersion(path string) (string, error) {
+	if rev, err := gitRevision(filepath.Join(path, ".git")); err == nil {
+		return "git:" + rev, nil
+	}
+	h := sha256.New()
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", rel, len(data))
+		h.Write(data)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// gitRevision resolves HEAD of the git dir gitDir
+func gitRevision(gitDir string) (string, error) {
+	head, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: ") {
+		return ref, nil
+	}
+	ref = strings.TrimPrefix(ref, "ref: ")
+	if rev, err := ioutil.ReadFile(filepath.Join(gitDir, ref)); err == nil {
+		return strings.TrimSpace(string(rev)), nil
+	}
+	packed, err := ioutil.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range bytes.Split(packed, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("Unable to resolve %s", ref)
+}
+
+// copyDir recursively copies the dir src to dst
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode())
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,102 @@
+package executor
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheTTL = time.Minute
+
+type cacheEntry struct {
+	res     *CmdResult
+	expires time.Time
+	// done is closed once the run that fills the entry has finished
+	done chan struct{}
+}
+
+// resultCache holds the results of cacheable commands until their TTL expires
+type resultCache struct {
+	entries map[string]*cacheEntry
+	sync.Mutex
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{entries: make(map[string]*cacheEntry)}
+}
+
+// cacheKey identifies runs of the same command with the same rendered args for the same
+// entities of an incident
+func cacheKey(cmd *Command) string {
+	var entities []string
+	if cmd.Input != nil {
+		entities = cmd.Input.Entities()
+		sort.Strings(entities)
+	}
+	parts := []string{cmd.Runner, cmd.Command, strings.Join(cmd.Args, "\x00"), strings.Join(entities, ",")}
+	return strings.Join(parts, "\x01")
+}
+
+// cacheable returns true if the command passed. Failures, including results that did not
+// pass, are not cached so that the next run, or the retry of the command, runs it again.
+func cacheable(res *CmdResult) bool {
+	return !res.Failed()
+}
+
+// wrap wraps run so that the results of cacheable commands are reused until they expire.
+// Commands that are run while an identical command is running wait for its result.
+func (c *resultCache) wrap(run runFunc) runFunc {
+	if c == nil {
+		return run
+	}
+	return func(ctx context.Context, cmd *Command) *CmdResult {
+		if !cmd.Cacheable || cmd.DryRun {
+			return run(ctx, cmd)
+		}
+		key := cacheKey(cmd)
+		c.Lock()
+		now := time.Now()
+		for k, entry := range c.entries {
+			if entry.res != nil && now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		entry, ok := c.entries[key]
+		if ok {
+			c.Unlock()
+			select {
+			case <-entry.done:
+			case <-ctx.Done():
+				return run(ctx, cmd)
+			}
+			if entry.res != nil {
+				res := *entry.res
+				res.Command, res.Cached = cmd, true
+				return &res
+			}
+			return run(ctx, cmd)
+		}
+		entry = &cacheEntry{done: make(chan struct{})}
+		c.entries[key] = entry
+		c.Unlock()
+
+		res := run(ctx, cmd)
+		ttl := cmd.CacheTTL
+		if ttl == 0 {
+			ttl = defaultCacheTTL
+		}
+		c.Lock()
+		if cacheable(res) {
+			// callers modify the result they get back
+			stored := *res
+			entry.res, entry.expires = &stored, time.Now().Add(ttl)
+		} else {
+			delete(c.entries, key)
+		}
+		c.Unlock()
+		close(entry.done)
+		return res
+	}
+}
@@ -0,0 +1,42 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DryRunFlag is passed to commands that support dry run when they are run in dry run mode
+const DryRunFlag = "--dry_run"
+
+// Describe returns the command line the command runs
+func (c *Command) Describe() string {
+	parts := append([]string{c.Command}, c.Args...)
+	return fmt.Sprintf("%s: %s", c.Name, strings.Join(parts, " "))
+}
+
+// withDryRun wraps run so that commands in dry run mode are invoked with DryRunFlag if
+// they support it, and are otherwise skipped with a passing result describing what
+// would have run.
+func withDryRun(run runFunc) runFunc {
+	return func(ctx context.Context, cmd *Command) *CmdResult {
+		if !cmd.DryRun {
+			return run(ctx, cmd)
+		}
+		if !cmd.SupportsDryRun {
+			return &CmdResult{
+				Command: cmd,
+				Result: &Result{
+					Version: ResultVersion,
+					Passed:  passed(true),
+					Message: fmt.Sprintf("Dry run, skipped %s", cmd.Describe()),
+				},
+			}
+		}
+		dry := *cmd
+		dry.Args = append(append([]string{}, cmd.Args...), DryRunFlag, "true")
+		res := run(ctx, &dry)
+		res.Command = cmd
+		return res
+	}
+}
@@ -6,140 +6,540 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
-	getter "github.com/hashicorp/go-getter"
 )
 
-const defaultTimeout = 30 * time.Second
+const (
+	defaultTimeout   = 30 * time.Second
+	defaultKillGrace = 5 * time.Second
+	redactedSecret   = "[REDACTED]"
+	// exit code used by the runner when the requested script does not exist
+	exitNotFound = 127
+	// exit code used by the runner when the scripts package cannot be imported
+	exitImportFailed = 126
+)
 
 var runnerCmd string = "runner.py"
 
 type Command struct {
-	Input   *Incident `json:",omitempty"`
-	Name    string
+	Input *Incident `json:",omitempty"`
+	Name  string
+	Type  string `json:",omitempty"`
+	// Runner runs script commands, see RunnerPython, RunnerExec, RunnerShell and RunnerHTTP
+	Runner  string `json:",omitempty"`
 	Command string
-	Args    []string      `json:",omitempty"`
-	Timeout time.Duration `json:",omitempty"`
-	Env     []string      `json:",omitempty"`
+	// Args and Env are text/templates rendered against the Input before the command runs
+	Args      []string      `json:",omitempty"`
+	Timeout   time.Duration `json:",omitempty"`
+	Env       []string      `json:",omitempty"`
+	DependsOn []string      `json:",omitempty" yaml:"depends_on"`
+	Parallel  bool          `json:",omitempty"`
+	// Retries is the number of times a failed command is retried, if the failure
+	// matches RetryOn (exit codes or failure classes). The backoff doubles every attempt.
+	// Commands that report they did not pass are only retried on an explicit not_passed
+	// or the code they exited with.
+	Retries      int           `json:",omitempty"`
+	RetryBackoff time.Duration `json:",omitempty" yaml:"retry_backoff"`
+	RetryOn      []string      `json:",omitempty" yaml:"retry_on"`
+	// BundleVersion pins the version of the scripts bundle the command runs from
+	BundleVersion string `json:",omitempty" yaml:"bundle_version"`
+	// SupportsDryRun marks commands that accept DryRunFlag, in dry run mode they are
+	// invoked with it instead of being skipped
+	SupportsDryRun bool `json:",omitempty" yaml:"supports_dry_run"`
+	// DryRun is set on commands that are run in dry run mode
+	DryRun bool `json:",omitempty" yaml:"-"`
+	// Secrets maps env vars to references of the secrets that are injected into them
+	Secrets map[string]string `json:",omitempty"`
+	// Isolation isolates script commands from the daemon and the host
+	Isolation *Isolation `json:",omitempty"`
+	// Region is the region of the workers that run the command with a RemoteExecutor
+	Region string `json:",omitempty"`
+	// HTTP configures commands run with RunnerHTTP
+	HTTP *HTTPJob `json:",omitempty"`
+	// Cacheable marks idempotent commands whose passing results are reused for CacheTTL
+	// by runs of the same command with the same args for the same entities
+	Cacheable bool          `json:",omitempty"`
+	CacheTTL  time.Duration `json:",omitempty" yaml:"cache_ttl"`
+	// Undo are run to roll back the command if a later step of its remediation fails
+	Undo []Command `json:",omitempty"`
+	// RequireApproval pauses the command until its Approval func approves it
+	RequireApproval bool         `json:",omitempty" yaml:"require_approval"`
+	Approval        ApprovalFunc `json:"-" yaml:"-"`
+	// Logs receives the output of the command line by line while it runs
+	Logs *LogBuffer `json:"-" yaml:"-"`
 }
 
+// Failure classifies why a command failed
+type Failure string
+
+const (
+	FailureNone           Failure = ""
+	FailureExitNonZero    Failure = "exit_nonzero"
+	FailureNotPassed      Failure = "not_passed"
+	FailureTimeout        Failure = "timeout"
+	FailureCancelled      Failure = "cancelled"
+	FailureKilledBySignal Failure = "killed_by_signal"
+	FailureStartFailed    Failure = "start_failed"
+	FailureNotFound       Failure = "not_found"
+	FailureBadOutput      Failure = "bad_output"
+	FailureTemplate       Failure = "template"
+	FailureSecret         Failure = "secret"
+	FailureWorker         Failure = "worker"
+	FailureRejected       Failure = "rejected"
+)
+
 type CmdResult struct {
+	Command *Command `json:"-"`
 	RetCode int
 	Error   error
 	Stdout  string
 	Stderr  string
 	Runtime time.Duration
+	// StartTime and EndTime are when the command was started and when it finished
+	StartTime time.Time
+	EndTime   time.Time
+	// UserTime, SysTime and MaxRSS (in bytes) are the resource usage of a script command
+	UserTime time.Duration
+	SysTime  time.Duration
+	MaxRSS   int64
+	Result   *Result
+	Failure  Failure
+	Attempt  int
+	// Args and Env are the rendered args and env the command ran with
+	Args []string
+	Env  []string
+	// BundleVersion is the version of the scripts bundle the command ran from
+	BundleVersion string
+	// StdoutArtifact and StderrArtifact are the paths in the artifact store of the full
+	// output of streams that were truncated
+	StdoutArtifact string
+	StderrArtifact string
+	// Artifacts are the files the command wrote to its artifacts dir
+	Artifacts []Artifact
+	// Cached is set if the result is that of an earlier run of the command
+	Cached bool
+}
+
+func failedResult(cmd *Command, failure Failure, err error) *CmdResult {
+	return &CmdResult{Command: cmd, Failure: failure, Error: err}
+}
+
+// Failed returns true if the command could not be run, or if it reported that it did
+// not pass. Commands that dont report a result fail when they exit non-zero.
+func (r *CmdResult) Failed() bool {
+	if r.Error != nil {
+		return true
+	}
+	if r.Result != nil && r.Result.Passed != nil {
+		return !*r.Result.Passed
+	}
+	return r.RetCode != 0
+}
+
+// classify sets the failure class of a finished command that failed, unless already set.
+func (r *CmdResult) classify() {
+	if r.Failure != FailureNone || !r.Failed() {
+		return
+	}
+	switch {
+	case r.Error != nil:
+		r.Failure = FailureStartFailed
+	// the runner also reports passed false when it cannot run the script, the exit
+	// code tells these apart from scripts that did not pass
+	case r.RetCode == exitNotFound:
+		r.Failure = FailureNotFound
+	case r.RetCode == exitImportFailed:
+		r.Failure = FailureStartFailed
+	case r.Result != nil && r.Result.Passed != nil && !*r.Result.Passed:
+		// scripts exit non zero when they report that they did not pass
+		r.Failure = FailureNotPassed
+	case r.RetCode != 0:
+		r.Failure = FailureExitNonZero
+	default:
+		r.Failure = FailureNotPassed
+	}
+}
+
+// Message returns the message reported by the command, if any.
+func (r *CmdResult) Message() string {
+	if r.Result == nil {
+		return ""
+	}
+	return r.Result.Message
+}
+
+// SecretResolver resolves the secret references of commands
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretEnv is implemented by secret resolvers that read secrets from the env of the daemon
+type SecretEnv interface {
+	// IsSecretEnv returns true if the env var name may hold a secret
+	IsSecretEnv(name string) bool
 }
 
 type Executioner interface {
-	Execute(ctx context.Context, cmds []Command, maxParallel int) map[*Command]*CmdResult
+	// Execute runs cmds in dependency order and returns the results of every attempt of
+	// the commands that ran, in dependency order. Steps that depend on a failed step are
+	// not run.
+	Execute(ctx context.Context, cmds []Command, maxParallel int) []*CmdResult
+}
+
+// Options configures an Executor
+type Options struct {
+	ScriptsPath   string
+	ScriptsURL    string
+	CommonOpts    string
+	FetchInterval time.Duration
+	// BundlesDir is where fetched script bundles are kept, ScriptsPath is a symlink to
+	// the active bundle
+	BundlesDir string
+	// KeepBundles is the number of bundles kept around for rollback
+	KeepBundles int
+	// ValidateCmd is run from a newly fetched bundle, which is only activated if it succeeds
+	ValidateCmd []string
+	// MaxOutputSize is the number of bytes of each output stream of a command that are
+	// kept, the full output of streams that are larger is stored in the artifact store
+	MaxOutputSize int
+	ArtifactsDir  string
+	Secrets       SecretResolver
+	// KillGrace is how long a timed out command's process group is given to exit
+	// after SIGTERM before it is sent SIGKILL
+	KillGrace time.Duration
 }
 
 type Executor struct {
 	scriptsPath string
 	commonOpts  string
+	killGrace   time.Duration
+	bundles     *bundles
+	maxOutput   int
+	artifacts   *ArtifactStore
+	secrets     SecretResolver
+	cache       *resultCache
 }
 
-func NewExecutor(scriptsPath, scriptsURL, commonOpts string, fetchInterval time.Duration) Executioner {
-	e := &Executor{scriptsPath: scriptsPath, commonOpts: commonOpts}
-	glog.Infof("Fetching scripts from %s", scriptsURL)
-	if err := getter.GetAny(e.scriptsPath, scriptsURL); err != nil {
-		glog.Exitf("FATAL error: Failed to fetch any scripts: %v", err)
+func NewExecutor(opts Options) Executioner {
+	e := &Executor{
+		scriptsPath: opts.ScriptsPath,
+		commonOpts:  opts.CommonOpts,
+		killGrace:   opts.KillGrace,
+		maxOutput:   opts.MaxOutputSize,
+		artifacts:   NewArtifactStore(opts.ArtifactsDir),
+		secrets:     opts.Secrets,
+		cache:       newResultCache(),
+	}
+	if e.killGrace == 0 {
+		e.killGrace = defaultKillGrace
+	}
+	fetchInterval := opts.FetchInterval
+	if fetchInterval == 0 {
+		fetchInterval = defaultFetchInterval
+	}
+	e.bundles = newBundles(opts)
+	glog.Infof("Fetching scripts from %s", opts.ScriptsURL)
+	if err := e.bundles.update(); err != nil {
+		if e.bundles.current() == "" {
+			glog.Exitf("FATAL error: Failed to fetch any scripts: %v", err)
+		}
+		glog.Errorf("Failed to update scripts, using bundle %s: %v", e.bundles.current(), err)
 	}
 	go func() {
 		for {
 			time.Sleep(fetchInterval)
-			glog.V(2).Infof("Fetching scripts from %s", scriptsURL)
-			if err := getter.GetAny(e.scriptsPath, scriptsURL); err != nil {
-				glog.Errorf("Failed to fetch scripts: %v", err)
+			if e.bundles.Paused() {
+				glog.V(2).Infof("Scripts updates are paused, not fetching")
+				continue
+			}
+			glog.V(2).Infof("Fetching scripts from %s", opts.ScriptsURL)
+			if err := e.bundles.update(); err != nil {
+				glog.Errorf("Failed to update scripts: %v", err)
 			}
 		}
 	}()
 	return e
 }
 
-func (e *Executor) Execute(ctx context.Context, cmds []Command, maxParallel int) map[*Command]*CmdResult {
-	ret := make(map[*Command]*CmdResult)
-	sem := make(chan struct{}, maxParallel)
-	var wg sync.WaitGroup
-	for _, cmd := range cmds {
-		sem <- struct{}{}
-		wg.Add(1)
-		go func(cmd Command) {
-			defer func() {
-				wg.Done()
-				<-sem
-			}()
-			if cmd.Timeout == 0 {
-				cmd.Timeout = defaultTimeout
-			}
-			ctx, cancel := context.WithTimeout(ctx, cmd.Timeout)
-			defer cancel()
-			fullPath := filepath.Join(e.scriptsPath, runnerCmd)
-			args := []string{"--scripts_path", e.scriptsPath, "--script_name", cmd.Command, "--common_opts_file", e.commonOpts}
-			args = append(args, cmd.Args...)
-			command := exec.CommandContext(ctx, fullPath, args...)
-			// start the command in its own pg
-			command.SysProcAttr = &syscall.SysProcAttr{
-				Setpgid: true,
-			}
-			if len(cmd.Env) > 0 {
-				command.Env = cmd.Env
-			}
-			stdin, err := command.StdinPipe()
-			if err != nil {
-				ret[&cmd] = &CmdResult{Error: fmt.Errorf("Failed to open stdin for cmd: %s: %v", fullPath, err)}
-				return
-			}
-			stdout, err := command.StdoutPipe()
-			if err != nil {
-				ret[&cmd] = &CmdResult{Error: fmt.Errorf("Failed to open stdout for cmd: %s: %v", fullPath, err)}
-				return
-			}
-			stderr, err := command.StderrPipe()
-			if err != nil {
-				ret[&cmd] = &CmdResult{Error: fmt.Errorf("Failed to open stderr for cmd: %s: %v", fullPath, err)}
-				return
-			}
-			data, err := json.Marshal(&cmd.Input)
-			if err != nil {
-				ret[&cmd] = &CmdResult{Error: fmt.Errorf("Unable to marshal stdin for cmd: %s: %v", fullPath, err)}
-				return
+// isSecretEnv returns true if the env var name of the daemon may hold a secret, commands
+// only get the secrets they declare
+func (e *Executor) isSecretEnv(name string) bool {
+	se, ok := e.secrets.(SecretEnv)
+	return ok && se.IsSecretEnv(name)
+}
+
+// BundleVersion returns the version of the active scripts bundle
+func (e *Executor) BundleVersion() string {
+	if e.bundles == nil {
+		return ""
+	}
+	return e.bundles.BundleVersion()
+}
+
+func (e *Executor) Rollback() error {
+	if e.bundles == nil {
+		return fmt.Errorf("Scripts bundles are not managed")
+	}
+	return e.bundles.Rollback()
+}
+
+func (e *Executor) Resume() error {
+	if e.bundles == nil {
+		return fmt.Errorf("Scripts bundles are not managed")
+	}
+	return e.bundles.Resume()
+}
+
+// scripts returns the scripts path and bundle version to run a command from. Managed
+// bundles are resolved so that the command keeps running from the same bundle even if a
+// new one is activated.
+func (e *Executor) scripts(version string) (string, string, func(), error) {
+	if e.bundles == nil {
+		if version != "" {
+			return "", "", nil, fmt.Errorf("Scripts bundles are not managed, cannot pin version %s", version)
+		}
+		return e.scriptsPath, "", func() {}, nil
+	}
+	return e.bundles.acquire(version)
+}
+
+func (e *Executor) Execute(ctx context.Context, cmds []Command, maxParallel int) []*CmdResult {
+	return schedule(ctx, cmds, maxParallel, withTemplates(withDryRun(withApproval(e.cache.wrap(e.run)))))
+}
+
+func (e *Executor) run(ctx context.Context, cmd *Command) *CmdResult {
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if cmd.Type == CmdTypeGo {
+		return runAction(ctx, cmd)
+	}
+	if cmd.Runner == RunnerHTTP {
+		return e.runHTTP(ctx, cmd)
+	}
+	scriptsPath, version, release, err := e.scripts(cmd.BundleVersion)
+	if err != nil {
+		return failedResult(cmd, FailureNotFound, err)
+	}
+	defer release()
+	res := e.runScript(ctx, cmd, scriptsPath, timeout)
+	res.BundleVersion = version
+	return res
+}
+
+func (e *Executor) runScript(ctx context.Context, cmd *Command, scriptsPath string, timeout time.Duration) *CmdResult {
+	fullPath, args, err := e.commandLine(cmd, scriptsPath)
+	if err != nil {
+		return failedResult(cmd, FailureNotFound, err)
+	}
+	iso := cmd.Isolation
+	path, argv := iso.wrap(fullPath, args)
+	command := exec.Command(path, argv...)
+	// start the command in its own pg so that it can be terminated along with its children
+	command.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Credential: iso.credential(),
+	}
+	if iso != nil && iso.TempDir {
+		dir, err := ioutil.TempDir("", "ar-run-")
+		if err != nil {
+			return failedResult(cmd, FailureStartFailed, fmt.Errorf("Failed to create working dir for cmd: %s: %v", fullPath, err))
+		}
+		defer os.RemoveAll(dir)
+		if err := iso.chown(dir); err != nil {
+			return failedResult(cmd, FailureStartFailed, fmt.Errorf("Failed to chown working dir for cmd: %s: %v", fullPath, err))
+		}
+		command.Dir = dir
+	}
+	secretEnv, redact, err := e.resolveSecrets(cmd)
+	if err != nil {
+		return failedResult(cmd, FailureSecret, err)
+	}
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return failedResult(cmd, FailureStartFailed, fmt.Errorf("Failed to open stdin for cmd: %s: %v", fullPath, err))
+	}
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return failedResult(cmd, FailureStartFailed, fmt.Errorf("Failed to open stdout for cmd: %s: %v", fullPath, err))
+	}
+	stderr, err := command.StderrPipe()
+	if err != nil {
+		return failedResult(cmd, FailureStartFailed, fmt.Errorf("Failed to open stderr for cmd: %s: %v", fullPath, err))
+	}
+	data, err := json.Marshal(&cmd.Input)
+	if err != nil {
+		return failedResult(cmd, FailureStartFailed, fmt.Errorf("Unable to marshal stdin for cmd: %s: %v", fullPath, err))
+	}
+	go func() {
+		defer stdin.Close()
+		io.WriteString(stdin, string(data))
+	}()
+	env := append(iso.env(cmd.Env, e.isSecretEnv), secretEnv...)
+	var artifactsDir string
+	if e.artifacts != nil {
+		dir, rel, err := e.artifacts.CreateDir(cmd.Name)
+		if err != nil {
+			glog.Errorf("Failed to create artifacts dir for cmd %s: %v", cmd.Name, err)
+		} else {
+			artifactsDir = rel
+			env = append(env, ArtifactsDirEnv+"="+dir)
+			if err := iso.chown(dir); err != nil {
+				glog.Errorf("Failed to chown artifacts dir for cmd %s: %v", cmd.Name, err)
 			}
-			go func() {
-				defer stdin.Close()
-				io.WriteString(stdin, string(data))
-			}()
-			if err := command.Start(); err != nil {
-				ret[&cmd] = &CmdResult{Error: fmt.Errorf("Unable to start cmd: %s: %v", fullPath, err)}
+		}
+	}
+	command.Env = env
+	if err := command.Start(); err != nil {
+		if artifactsDir != "" {
+			e.artifacts.Collect(artifactsDir)
+		}
+		return failedResult(cmd, FailureStartFailed, fmt.Errorf("Unable to start cmd: %s: %v", fullPath, err))
+	}
+	res := &CmdResult{Command: cmd, StartTime: time.Now()}
+	finished := make(chan struct{})
+	killed := make(chan error, 1)
+	go func() {
+		select {
+		case <-finished:
+			killed <- nil
+		case <-ctx.Done():
+			select {
+			case <-finished:
+				// the cmd exited as the context ended, its process group may be reaped already
+				killed <- nil
 				return
+			default:
 			}
-			startTime := time.Now()
-			res := &CmdResult{}
-			serr, _ := ioutil.ReadAll(stderr)
-			res.Stderr = string(serr)
-			sout, _ := ioutil.ReadAll(stdout)
-			res.Stdout = string(sout)
-
-			if err := command.Wait(); err != nil {
-				if exiterr, ok := err.(*exec.ExitError); ok {
-					if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-						res.RetCode = status.ExitStatus()
-					}
-				} else {
-					res.Error = err
+			killed <- ctx.Err()
+			e.terminate(command.Process.Pid, finished)
+		}
+	}()
+	// consume both streams concurrently so that neither pipe can fill up and block the cmd
+	var wg sync.WaitGroup
+	sout := newCapture(e.maxOutput, e.artifacts, cmd.Name, "stdout")
+	serr := newCapture(e.maxOutput, e.artifacts, cmd.Name, "stderr")
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		readLines(stdout, sout, cmd, "stdout", redact)
+	}()
+	go func() {
+		defer wg.Done()
+		readLines(stderr, serr, cmd, "stderr", redact)
+	}()
+	wg.Wait()
+	res.Stdout = sout.String()
+	res.Stderr = serr.String()
+	if res.StdoutArtifact, err = sout.close(); err != nil {
+		glog.Errorf("Failed to store stdout of cmd %s: %v", cmd.Name, err)
+	}
+	if res.StderrArtifact, err = serr.close(); err != nil {
+		glog.Errorf("Failed to store stderr of cmd %s: %v", cmd.Name, err)
+	}
+
+	waitErr := command.Wait()
+	close(finished)
+	switch <-killed {
+	case nil:
+	case context.DeadlineExceeded:
+		res.Failure = FailureTimeout
+		res.Error = fmt.Errorf("Cmd %s timed out after %v", cmd.Name, timeout)
+	default:
+		res.Failure = FailureCancelled
+		res.Error = fmt.Errorf("Cmd %s was cancelled", cmd.Name)
+	}
+	if waitErr != nil {
+		if exiterr, ok := waitErr.(*exec.ExitError); ok {
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				res.RetCode = status.ExitStatus()
+				if status.Signaled() && res.Failure == FailureNone {
+					res.Failure = FailureKilledBySignal
+					res.Error = fmt.Errorf("Cmd %s was killed by signal: %v", cmd.Name, status.Signal())
 				}
 			}
-			res.Runtime = time.Now().Sub(startTime)
-			ret[&cmd] = res
-		}(cmd)
+		} else if res.Error == nil {
+			res.Error = waitErr
+		}
+	}
+	res.EndTime = time.Now()
+	res.Runtime = res.EndTime.Sub(res.StartTime)
+	res.setUsage(command.ProcessState)
+	if artifactsDir != "" {
+		if res.Artifacts, err = e.artifacts.Collect(artifactsDir); err != nil {
+			glog.Errorf("Failed to collect artifacts of cmd %s: %v", cmd.Name, err)
+		}
+	}
+	if res.Result, err = parseResult(sout.result()); err != nil && res.Error == nil {
+		res.Failure = FailureBadOutput
+		res.Error = fmt.Errorf("Invalid result from cmd %s: %v", cmd.Name, err)
+	}
+	res.classify()
+	return res
+}
+
+// resolveSecrets returns the env entries of the secrets of cmd and a replacer that
+// redacts their values from its output
+func (e *Executor) resolveSecrets(cmd *Command) ([]string, *strings.Replacer, error) {
+	if len(cmd.Secrets) == 0 {
+		return nil, nil, nil
+	}
+	if e.secrets == nil {
+		return nil, nil, fmt.Errorf("Cmd %s requires secrets but no secret providers are configured", cmd.Name)
+	}
+	var (
+		env       []string
+		redacting []string
+	)
+	for name, ref := range cmd.Secrets {
+		val, err := e.secrets.Resolve(ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to resolve secret for %s: %v", name, err)
+		}
+		env = append(env, name+"="+val)
+		if val != "" {
+			redacting = append(redacting, val, redactedSecret)
+		}
+	}
+	return env, strings.NewReplacer(redacting...), nil
+}
+
+// setUsage records the resource usage of the finished process
+func (r *CmdResult) setUsage(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	r.UserTime = state.UserTime()
+	r.SysTime = state.SystemTime()
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// maxrss is in kilobytes on linux
+		r.MaxRSS = int64(usage.Maxrss) * 1024
+	}
+}
+
+// terminate sends SIGTERM to the process group pgid and SIGKILL if any of the group is
+// still around once the grace period has passed or the group leader has been reaped.
+func (e *Executor) terminate(pgid int, finished chan struct{}) {
+	glog.V(2).Infof("Terminating process group %d", pgid)
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		return
+	}
+	select {
+	case <-finished:
+	case <-time.After(e.killGrace):
+	}
+	if err := syscall.Kill(-pgid, 0); err == nil {
+		glog.V(2).Infof("Process group %d still running after SIGTERM, sending SIGKILL", pgid)
+		syscall.Kill(-pgid, syscall.SIGKILL)
 	}
-	wg.Wait()
-	return ret
 }
@@ -4,9 +4,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,6 +28,70 @@ func execute() {
 		fmt.Fprintf(os.Stderr, "Error reading standard input: %v", err)
 		os.Exit(1)
 	}
+	if i.Name == "hang" {
+		// spawn a child in the same process group and ignore SIGTERM
+		signal.Ignore(syscall.SIGTERM)
+		child := exec.Command("sleep", "60")
+		child.Start()
+		ioutil.WriteFile(i.Data["pidfile"].(string), []byte(strconv.Itoa(child.Process.Pid)), 0644)
+		time.Sleep(60 * time.Second)
+	}
+	if i.Name == "chatty" {
+		fmt.Fprintln(os.Stdout, strings.Repeat("x", 100*1024))
+		fmt.Fprintln(os.Stderr, "line 1")
+		fmt.Fprint(os.Stdout, strings.Repeat("y", 100*1024))
+		fmt.Fprintln(os.Stderr, "line 2")
+		os.Exit(0)
+	}
+	if i.Name == "chatty_result" {
+		fmt.Fprintln(os.Stdout, strings.Repeat("x", 100*1024))
+		fmt.Fprintln(os.Stdout, `{"passed": false, "message": "too chatty"}`)
+		os.Exit(1)
+	}
+	if i.Name == "artifacts" {
+		dir := os.Getenv(ArtifactsDirEnv)
+		os.MkdirAll(filepath.Join(dir, "diffs"), 0755)
+		ioutil.WriteFile(filepath.Join(dir, "show.txt"), []byte("show output"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "diffs", "config.diff"), []byte("-mtu 1500\n+mtu 9000\n"), 0644)
+		os.Exit(0)
+	}
+	if i.Name == "isolation" {
+		cwd, _ := os.Getwd()
+		var nofile, cpu syscall.Rlimit
+		syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofile)
+		syscall.Getrlimit(syscall.RLIMIT_CPU, &cpu)
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"cwd": cwd, "env": os.Environ(), "nofile": nofile.Cur, "cpu": cpu.Cur,
+		})
+		os.Exit(0)
+	}
+	if i.Name == "secrets" {
+		fmt.Fprintf(os.Stderr, "logging in with %s\n", os.Getenv("DEVICE_PASSWORD"))
+		fmt.Fprintf(os.Stdout, `{"passed": true, "message": "password is %s"}`, os.Getenv("DEVICE_PASSWORD"))
+		os.Exit(0)
+	}
+	if i.Name == "bad_output" {
+		fmt.Fprint(os.Stdout, `{"passed": tru`)
+		os.Exit(0)
+	}
+	if i.Name == "envelope" {
+		fmt.Fprintln(os.Stdout, "some debug output")
+		fmt.Fprint(os.Stdout, `{"version": 1, "passed": false, "message": "do not drain", "severity": "major"}`)
+		os.Exit(0)
+	}
+	// the output and exit codes of runner.py when it cannot run the script
+	if i.Name == "missing_script" {
+		fmt.Fprint(os.Stdout, `{"version": 1, "passed": false, "message": "Script not found"}`)
+		os.Exit(127)
+	}
+	if i.Name == "import_failed" {
+		fmt.Fprint(os.Stdout, `{"version": 1, "passed": false, "message": "Failed to import scripts pkg"}`)
+		os.Exit(126)
+	}
+	if i.Name == "not_passed" {
+		fmt.Fprint(os.Stdout, `{"passed": false, "message": "link is up"}`)
+		os.Exit(1)
+	}
 	if i.Name == "pass" {
 		fmt.Fprint(os.Stderr, "Successfully executed")
 		fmt.Fprint(os.Stdout, `{"result": "pass", "message": "good"}`)
@@ -36,11 +112,15 @@ func TestExecution(t *testing.T) {
 		Env:   []string{"testme=1"},
 	}
 	result := exe.Execute(context.Background(), []Command{cmd}, 1)
+	assert.Equal(t, len(result), 1)
 	for _, res := range result {
 		assert.Nil(t, res.Error)
 		assert.Equal(t, res.RetCode, 0)
 		assert.Equal(t, res.Stderr, "Successfully executed")
 		assert.Equal(t, res.Stdout, `{"result": "pass", "message": "good"}`)
+		assert.True(t, res.MaxRSS > 0)
+		assert.True(t, res.EndTime.After(res.StartTime))
+		assert.Equal(t, res.Runtime, res.EndTime.Sub(res.StartTime))
 	}
 	cmd = Command{
 		Input: &Incident{Name: "fail"},
@@ -48,6 +128,7 @@ func TestExecution(t *testing.T) {
 		Env:   []string{"testme=1"},
 	}
 	result = exe.Execute(context.Background(), []Command{cmd}, 1)
+	assert.Equal(t, len(result), 1)
 	for _, res := range result {
 		assert.Nil(t, res.Error)
 		assert.Equal(t, res.RetCode, 1)
@@ -56,6 +137,1092 @@ func TestExecution(t *testing.T) {
 	}
 }
 
+// alive returns true if pid exists and is not a zombie
+func alive(pid int) bool {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	return len(fields) > 2 && fields[2] != "Z"
+}
+
+func TestLogStreaming(t *testing.T) {
+	runnerCmd = os.Args[0]
+	exe := &Executor{maxOutput: 1024 * 1024}
+	logs := NewLogBuffer(0)
+	_, lines, cancel := logs.Subscribe()
+	defer cancel()
+	cmd := Command{
+		Input: &Incident{Name: "chatty"},
+		Name:  "Test chatty",
+		Env:   []string{"testme=1"},
+		Logs:  logs,
+	}
+	res := exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.False(t, res.Failed())
+	// more than a pipe buffer of stdout must not block the command
+	assert.Equal(t, len(res.Stdout), 200*1024+1)
+	assert.Equal(t, res.Stderr, "line 1\nline 2\n")
+	backlog, _, _ := logs.Subscribe()
+	assert.Equal(t, len(backlog), 4)
+	var stderr []string
+	for _, l := range backlog {
+		if l.Stream == "stderr" {
+			stderr = append(stderr, l.Line)
+		}
+	}
+	assert.Equal(t, stderr, []string{"line 1", "line 2"})
+	assert.Equal(t, (<-lines).Command, "Test chatty")
+	logs.Close()
+	assert.True(t, logs.Closed())
+}
+
+func TestOutputCapture(t *testing.T) {
+	runnerCmd = os.Args[0]
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := &Executor{maxOutput: 1024, artifacts: NewArtifactStore(dir)}
+	cmd := Command{
+		Input: &Incident{Name: "chatty"},
+		Name:  "Test chatty",
+		Env:   []string{"testme=1"},
+	}
+	res := exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.False(t, res.Failed())
+	assert.True(t, strings.HasPrefix(res.Stdout, strings.Repeat("x", 512)+"\n... [output truncated, "))
+	assert.True(t, strings.HasSuffix(res.Stdout, "] ...\n"+strings.Repeat("y", 512)))
+	assert.Contains(t, res.Stdout, "full output in artifact "+res.StdoutArtifact)
+	assert.Equal(t, res.Stderr, "line 1\nline 2\n")
+	assert.Equal(t, res.StderrArtifact, "")
+	f, err := exe.artifacts.Open(res.StdoutArtifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(f)
+	assert.Equal(t, len(data), 200*1024+1)
+	_, err = exe.artifacts.Open("../../etc/passwd")
+	assert.Error(t, err)
+
+	// the result envelope is parsed from the last line of the truncated output
+	cmd.Input = &Incident{Name: "chatty_result"}
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.NotEqual(t, res.StdoutArtifact, "")
+	assert.Equal(t, res.Failure, FailureNotPassed)
+	assert.Equal(t, res.Message(), "too chatty")
+
+	// without a store the output is only truncated
+	c := newCapture(10, nil, "cmd", "stdout")
+	fmt.Fprint(c, "0123456789abcdef")
+	assert.Equal(t, c.String(), "01234\n... [output truncated, 6 of 16 bytes omitted] ...\nbcdef")
+	path, err := c.close()
+	assert.Equal(t, path, "")
+	assert.Nil(t, err)
+	c = newCapture(64, nil, "cmd", "stdout")
+	fmt.Fprint(c, strings.Repeat("a", 100)+"\n"+`{"passed": true}`+"\n")
+	assert.Equal(t, c.result(), `{"passed": true}`)
+	// an envelope longer than the tail is not kept
+	c = newCapture(64, nil, "cmd", "stdout")
+	fmt.Fprint(c, strings.Repeat("a", 100))
+	assert.Equal(t, c.result(), "")
+}
+
+func TestArtifacts(t *testing.T) {
+	runnerCmd = os.Args[0]
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := &Executor{artifacts: NewArtifactStore(dir)}
+	cmds := []Command{
+		{Input: &Incident{Name: "artifacts"}, Name: "Save Artifacts", Env: []string{"testme=1"}},
+		{Input: &Incident{Name: "pass"}, Name: "No Artifacts", Env: []string{"testme=1"}},
+	}
+	results := exe.Execute(context.Background(), cmds, 1)
+	assert.Equal(t, len(results), 2)
+	artifacts := results[0].Artifacts
+	assert.Equal(t, len(artifacts), 2)
+	assert.Equal(t, artifacts[0].Name, "diffs/config.diff")
+	assert.Equal(t, artifacts[0].Size, int64(20))
+	assert.Equal(t, artifacts[1].Name, "show.txt")
+	f, err := exe.artifacts.Open(artifacts[1].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(f)
+	assert.Equal(t, string(data), "show output")
+	// empty artifacts dirs are removed
+	assert.Nil(t, results[1].Artifacts)
+	days, _ := ioutil.ReadDir(dir)
+	entries, _ := ioutil.ReadDir(filepath.Join(dir, days[0].Name()))
+	assert.Equal(t, len(entries), 1)
+}
+
+func TestIsolation(t *testing.T) {
+	runnerCmd = os.Args[0]
+	os.Setenv("AR_TEST_ALLOWED", "yes")
+	os.Setenv("AR_TEST_DENIED", "no")
+	defer os.Unsetenv("AR_TEST_ALLOWED")
+	defer os.Unsetenv("AR_TEST_DENIED")
+	exe := &Executor{}
+	cmd := Command{
+		Input: &Incident{Name: "isolation"},
+		Name:  "Test isolation",
+		Env:   []string{"testme=1"},
+		Isolation: &Isolation{
+			TempDir:      true,
+			EnvAllowlist: []string{"AR_TEST_ALLOWED", "PATH"},
+			CPUTime:      1500 * time.Millisecond,
+			MaxOpenFiles: 64,
+		},
+	}
+	res := exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.False(t, res.Failed())
+	var out struct {
+		Cwd    string
+		Env    []string
+		Nofile uint64
+		CPU    uint64
+	}
+	if err := json.Unmarshal([]byte(res.Stdout), &out); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(filepath.Base(out.Cwd), "ar-run-"))
+	_, err := os.Stat(out.Cwd)
+	assert.True(t, os.IsNotExist(err))
+	assert.Contains(t, out.Env, "AR_TEST_ALLOWED=yes")
+	assert.Contains(t, out.Env, "testme=1")
+	for _, env := range out.Env {
+		assert.False(t, strings.HasPrefix(env, "AR_TEST_DENIED="))
+	}
+	assert.Equal(t, out.Nofile, uint64(64))
+	assert.Equal(t, out.CPU, uint64(2))
+
+	iso := &Isolation{Uid: 65534, Gid: 65534}
+	assert.Equal(t, iso.credential(), &syscall.Credential{Uid: 65534, Gid: 65534})
+	path, args := iso.wrap("runner.py", []string{"--script_name", "foo"})
+	assert.Equal(t, path, "runner.py")
+	assert.Equal(t, args, []string{"--script_name", "foo"})
+	iso.MaxMemory = 512 * 1024 * 1024
+	path, args = iso.wrap("runner.py", []string{"--script_name", "foo"})
+	assert.Equal(t, path, "/bin/sh")
+	assert.Equal(t, args, []string{"-c", `ulimit -v 524288 && exec "$0" "$@"`, "runner.py", "--script_name", "foo"})
+}
+
+type mockSecrets map[string]string
+
+func (m mockSecrets) Resolve(ref string) (string, error) {
+	if val, ok := m[ref]; ok {
+		return val, nil
+	}
+	return "", fmt.Errorf("Secret %s not found", ref)
+}
+
+func TestSecrets(t *testing.T) {
+	runnerCmd = os.Args[0]
+	exe := &Executor{secrets: mockSecrets{"vault:junos_password": "s3cret"}}
+	logs := NewLogBuffer(0)
+	cmd := Command{
+		Input:   &Incident{Name: "secrets"},
+		Name:    "Test secrets",
+		Env:     []string{"testme=1"},
+		Secrets: map[string]string{"DEVICE_PASSWORD": "vault:junos_password"},
+		Logs:    logs,
+	}
+	res := exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.False(t, res.Failed())
+	assert.Equal(t, res.Stderr, "logging in with [REDACTED]\n")
+	assert.Equal(t, res.Message(), "password is [REDACTED]")
+	assert.NotContains(t, res.Stdout, "s3cret")
+	backlog, _, _ := logs.Subscribe()
+	var stderr []string
+	for _, l := range backlog {
+		if l.Stream == "stderr" {
+			stderr = append(stderr, l.Line)
+		}
+	}
+	assert.Equal(t, stderr, []string{"logging in with [REDACTED]"})
+	assert.Equal(t, res.Env, []string{"testme=1"})
+
+	cmd.Secrets = map[string]string{"DEVICE_PASSWORD": "vault:missing"}
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.True(t, res.Failed())
+	assert.Equal(t, res.Failure, FailureSecret)
+	exe.secrets = nil
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.Equal(t, res.Failure, FailureSecret)
+
+	// only steps that run a process get secrets
+	assert.Nil(t, ValidateSteps([]Command{cmd}))
+	secrets := map[string]string{"TOKEN": "vault:token"}
+	assert.Error(t, ValidateSteps([]Command{{Name: "Comment", Type: CmdTypeGo, Command: "task_comment", Secrets: secrets}}))
+	assert.Error(t, ValidateSteps([]Command{{Name: "Job", Runner: RunnerHTTP, Command: "http://awx/jobs", Secrets: secrets}}))
+}
+
+// envSecrets resolves secrets from the env vars with its prefix
+type envSecrets string
+
+func (e envSecrets) Resolve(ref string) (string, error) {
+	return os.Getenv(string(e) + ref), nil
+}
+
+func (e envSecrets) IsSecretEnv(name string) bool {
+	return strings.HasPrefix(name, string(e))
+}
+
+func TestSecretEnv(t *testing.T) {
+	runnerCmd = os.Args[0]
+	os.Setenv("testme", "1")
+	os.Setenv("AR_SECRET_junos_password", "s3cret")
+	os.Setenv("AR_SECRET_jira_token", "t0ken")
+	defer os.Unsetenv("testme")
+	defer os.Unsetenv("AR_SECRET_junos_password")
+	defer os.Unsetenv("AR_SECRET_jira_token")
+	exe := &Executor{secrets: envSecrets("AR_SECRET_")}
+	env := func(iso *Isolation) []string {
+		cmd := Command{
+			Input:     &Incident{Name: "isolation"},
+			Name:      "Test secret env",
+			Secrets:   map[string]string{"DEVICE_PASSWORD": "junos_password"},
+			Isolation: iso,
+		}
+		res := exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+		assert.False(t, res.Failed())
+		var out struct{ Env []string }
+		if err := json.Unmarshal([]byte(res.Stdout), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Env
+	}
+	// only the declared secret is visible, whether the env is inherited or allowlisted
+	for _, iso := range []*Isolation{nil, {EnvAllowlist: []string{"testme", "AR_SECRET_jira_token"}}} {
+		out := env(iso)
+		assert.Contains(t, out, "testme=1")
+		// the value of the declared secret is redacted from the output
+		assert.Contains(t, out, "DEVICE_PASSWORD=[REDACTED]")
+		for _, kv := range out {
+			assert.False(t, strings.HasPrefix(kv, "AR_SECRET_"), kv)
+		}
+	}
+}
+
+func TestExecutionTimeout(t *testing.T) {
+	runnerCmd = os.Args[0]
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+	exe := &Executor{killGrace: 200 * time.Millisecond}
+	cmd := Command{
+		Input:   &Incident{Name: "hang", Data: map[string]interface{}{"pidfile": pidFile}},
+		Name:    "Test hang",
+		Env:     []string{"testme=1", "PATH=" + os.Getenv("PATH")},
+		Timeout: 500 * time.Millisecond,
+	}
+	start := time.Now()
+	res := exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.True(t, time.Now().Sub(start) < 5*time.Second)
+	assert.Equal(t, res.Failure, FailureTimeout)
+	assert.True(t, res.Failed())
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(string(data))
+	// the child is killed along with the group but may take a moment to exit
+	for deadline := time.Now().Add(time.Second); alive(pid) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, alive(pid))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	cmd.Timeout = time.Minute
+	res = exe.Execute(ctx, []Command{cmd}, 1)[0]
+	assert.Equal(t, res.Failure, FailureCancelled)
+}
+
+func TestExecutionResult(t *testing.T) {
+	runnerCmd = os.Args[0]
+	exe := &Executor{}
+	cmd := Command{
+		Input: &Incident{Name: "envelope"},
+		Name:  "Test envelope",
+		Env:   []string{"testme=1"},
+	}
+	result := exe.Execute(context.Background(), []Command{cmd}, 1)
+	assert.Equal(t, len(result), 1)
+	res := result[0]
+	assert.Equal(t, res.RetCode, 0)
+	assert.True(t, res.Failed())
+	assert.Equal(t, res.Message(), "do not drain")
+	assert.Equal(t, res.Result.Severity, "major")
+
+	assert.Equal(t, res.Failure, FailureNotPassed)
+
+	// scripts that did not pass exit 1, they are not retried unless asked to
+	cmd.Input = &Incident{Name: "not_passed"}
+	cmd.Retries, cmd.RetryBackoff = 1, time.Millisecond
+	result = exe.Execute(context.Background(), []Command{cmd}, 1)
+	assert.Equal(t, len(result), 1)
+	assert.Equal(t, result[0].RetCode, 1)
+	assert.Equal(t, result[0].Failure, FailureNotPassed)
+	cmd.RetryOn = []string{"exit_nonzero"}
+	result = exe.Execute(context.Background(), []Command{cmd}, 1)
+	assert.Equal(t, len(result), 1)
+	cmd.RetryOn = []string{"1"}
+	result = exe.Execute(context.Background(), []Command{cmd}, 1)
+	assert.Equal(t, len(result), 2)
+	cmd.RetryOn = []string{"not_passed"}
+	result = exe.Execute(context.Background(), []Command{cmd}, 1)
+	assert.Equal(t, len(result), 2)
+	assert.Equal(t, result[1].Failure, FailureNotPassed)
+	cmd.Retries, cmd.RetryOn = 0, nil
+
+	cmd.Input = &Incident{Name: "fail"}
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.Equal(t, res.Failure, FailureExitNonZero)
+
+	cmd.Input = &Incident{Name: "bad_output"}
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.Equal(t, res.Failure, FailureBadOutput)
+
+	missing := &Executor{scriptsPath: "/nonexistent"}
+	res = missing.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.Equal(t, res.Failure, FailureNotFound)
+
+	// the runner reports passed false for scripts it cannot run
+	cmd.Input = &Incident{Name: "missing_script"}
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.Equal(t, res.Failure, FailureNotFound)
+	assert.Equal(t, res.Message(), "Script not found")
+	cmd.Input = &Incident{Name: "import_failed"}
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.Equal(t, res.Failure, FailureStartFailed)
+
+	cmd.Input = &Incident{Name: "pass"}
+	res = exe.Execute(context.Background(), []Command{cmd}, 1)[0]
+	assert.False(t, res.Failed())
+	assert.Equal(t, res.Failure, FailureNone)
+	assert.Nil(t, res.Result.Passed)
+	assert.Equal(t, res.Message(), "good")
+}
+
+func TestActions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"drained": true}`)
+	}))
+	defer ts.Close()
+	RegisterAction("echo", ActionFunc(func(ctx context.Context, cmd *Command) (*Result, error) {
+		p := cmd.Input.Name == "pass"
+		return &Result{Passed: &p, Message: ParseArgs(cmd.Args)["msg"]}, nil
+	}))
+	exe := &Executor{}
+	cmds := []Command{
+		{Name: "echo", Type: CmdTypeGo, Command: "echo", Args: []string{"--msg", "hello"}, Input: &Incident{Name: "pass"}},
+		{Name: "wait", Type: CmdTypeGo, Command: "wait", Args: []string{"--duration=10ms"}},
+		{Name: "http", Type: CmdTypeGo, Command: "http", Args: []string{"--url", ts.URL + "/drain", "--method", "POST"}},
+	}
+	results := exe.Execute(context.Background(), cmds, 1)
+	assert.Equal(t, len(results), 3)
+	for _, res := range results {
+		assert.False(t, res.Failed())
+	}
+	assert.Equal(t, results[0].Message(), "hello")
+	assert.Contains(t, results[0].Stdout, `"message":"hello"`)
+	assert.Equal(t, results[2].Result.Data["body"], map[string]interface{}{"drained": true})
+
+	cmds = []Command{{Name: "http", Type: CmdTypeGo, Command: "http", Args: []string{"--url", ts.URL + "/fail"}}}
+	res := exe.Execute(context.Background(), cmds, 1)[0]
+	assert.True(t, res.Failed())
+	assert.Nil(t, res.Error)
+
+	cmds = []Command{{Name: "wait", Type: CmdTypeGo, Command: "wait", Args: []string{"--duration", "1m"}, Timeout: 10 * time.Millisecond}}
+	res = exe.Execute(context.Background(), cmds, 1)[0]
+	assert.NotNil(t, res.Error)
+
+	cmds = []Command{{Name: "missing", Type: CmdTypeGo, Command: "missing"}}
+	res = exe.Execute(context.Background(), cmds, 1)[0]
+	assert.NotNil(t, res.Error)
+}
+
+func TestParseResult(t *testing.T) {
+	res, err := parseResult("plain text output")
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+
+	res, err = parseResult(`{"passed": true, "message": "ok", "data": {"links": 2}, "suggested_next": "drain"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, res.Version, 1)
+	assert.True(t, *res.Passed)
+	assert.Equal(t, res.Data["links"], float64(2))
+	assert.Equal(t, res.SuggestedNext, "drain")
+
+	_, err = parseResult(`{"passed": tru`)
+	assert.NotNil(t, err)
+	_, err = parseResult(`{"version": 99, "passed": true}`)
+	assert.NotNil(t, err)
+}
+
+func TestBundlesMigration(t *testing.T) {
+	runnerCmd = "runner.py"
+	root, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// scripts fetched into the scripts path before it was managed as bundles
+	scripts := filepath.Join(root, "scripts")
+	os.MkdirAll(scripts, 0755)
+	if err := ioutil.WriteFile(filepath.Join(scripts, "runner.py"), []byte("v0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := newBundles(Options{ScriptsPath: scripts, ScriptsURL: filepath.Join(root, "missing")})
+	err = b.update()
+	assert.Contains(t, err.Error(), "Failed to fetch scripts")
+	// the existing scripts are the active bundle even though the fetch failed
+	assert.NotEqual(t, b.current(), "")
+	assert.Regexp(t, "^sha256:[0-9a-f]{12}$", b.BundleVersion())
+	data, err := ioutil.ReadFile(filepath.Join(scripts, "runner.py"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "v0")
+	fi, _ := os.Lstat(scripts)
+	assert.True(t, fi.Mode()&os.ModeSymlink != 0)
+}
+
+func TestBundles(t *testing.T) {
+	runnerCmd = "runner.py"
+	root, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "src")
+	os.MkdirAll(filepath.Join(src, "audits"), 0755)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("runner.py", "v1")
+	write("audits/check.py", "ok")
+	opts := Options{
+		ScriptsPath: filepath.Join(root, "scripts"),
+		ScriptsURL:  src,
+		KeepBundles: 2,
+		ValidateCmd: []string{"sh", "-c", "grep -q ok audits/check.py"},
+	}
+	b := newBundles(opts)
+	current := func() string {
+		data, _ := ioutil.ReadFile(filepath.Join(opts.ScriptsPath, "runner.py"))
+		return string(data)
+	}
+	assert.Nil(t, b.update())
+	first := b.current()
+	assert.Equal(t, current(), "v1")
+	v1 := b.BundleVersion()
+	assert.Regexp(t, "^sha256:[0-9a-f]{12}$", v1)
+	// unchanged bundles are not activated again
+	assert.Nil(t, b.update())
+	assert.Equal(t, b.current(), first)
+	// the active bundle is a snapshot of the source
+	write("runner.py", "v2")
+	assert.Equal(t, current(), "v1")
+
+	// bundles failing validation are refused
+	write("audits/check.py", "syntax error")
+	assert.Error(t, b.update())
+	assert.Equal(t, b.current(), first)
+	assert.Equal(t, current(), "v1")
+
+	write("audits/check.py", "ok")
+	assert.Nil(t, b.update())
+	assert.Equal(t, current(), "v2")
+	assert.NotEqual(t, b.BundleVersion(), v1)
+	path, version, release, err := b.acquire("")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Base(path), "scripts")
+	assert.Equal(t, version, b.BundleVersion())
+	pinned := b.current()
+	// commands can pin the version of a kept bundle
+	path, version, unpin, err := b.acquire(v1)
+	assert.Nil(t, err)
+	assert.Equal(t, version, v1)
+	assert.Equal(t, path, b.path(first))
+	unpin()
+	_, _, _, err = b.acquire("sha256:000000000000")
+	assert.Error(t, err)
+
+	// old bundles are pruned unless in use
+	write("runner.py", "v3")
+	assert.Nil(t, b.update())
+	write("runner.py", "v4")
+	assert.Nil(t, b.update())
+	ids, _ := b.list()
+	assert.Equal(t, len(ids), 3)
+	assert.Contains(t, ids, pinned)
+	assert.NotContains(t, ids, first)
+	release()
+	b.prune()
+	ids, _ = b.list()
+	assert.Equal(t, len(ids), 2)
+
+	assert.Nil(t, b.Rollback())
+	assert.Equal(t, current(), "v3")
+	assert.True(t, b.Paused())
+	assert.Nil(t, b.Resume())
+	assert.False(t, b.Paused())
+	assert.Error(t, b.Rollback())
+
+	// scripts paths that are neither a dir nor a symlink are left alone
+	os.Remove(opts.ScriptsPath)
+	ioutil.WriteFile(opts.ScriptsPath, []byte("foo"), 0644)
+	err = b.update()
+	assert.Contains(t, err.Error(), "exists and is not a directory or symlink")
+
+	// git checkouts are versioned by their revision
+	os.MkdirAll(filepath.Join(src, ".git", "refs", "heads"), 0755)
+	write(".git/HEAD", "ref: refs/heads/master\n")
+	write(".git/refs/heads/master", "0123456789abcdef\n")
+	version, err = bundleVersion(src)
+	assert.Nil(t, err)
+	assert.Equal(t, version, "git:0123456789abcdef")
+}
+
+func TestStepOrdering(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	run := func(ctx context.Context, cmd *Command) *CmdResult {
+		mu.Lock()
+		ran = append(ran, cmd.Name)
+		mu.Unlock()
+		if cmd.Command == "fail" {
+			return &CmdResult{Command: cmd, RetCode: 1}
+		}
+		return &CmdResult{Command: cmd}
+	}
+	names := func(results []*CmdResult) []string {
+		var ret []string
+		for _, r := range results {
+			ret = append(ret, r.Command.Name)
+		}
+		return ret
+	}
+	// sequential by default
+	cmds := []Command{{Name: "drain"}, {Name: "verify"}, {Name: "notify"}}
+	results := schedule(context.Background(), cmds, len(cmds), run)
+	assert.Equal(t, names(results), []string{"drain", "verify", "notify"})
+	assert.Equal(t, ran, []string{"drain", "verify", "notify"})
+
+	// failures stop downstream steps
+	ran = nil
+	cmds = []Command{{Name: "drain", Command: "fail"}, {Name: "verify"}, {Name: "notify"}}
+	results = schedule(context.Background(), cmds, len(cmds), run)
+	assert.Equal(t, names(results), []string{"drain"})
+	assert.True(t, results[0].Failed())
+
+	// steps after a parallel group wait for the whole group
+	ran = nil
+	cmds = []Command{{Name: "drain", Command: "fail"}, {Name: "shift", Parallel: true}, {Name: "notify"}}
+	deps, err := stepDeps(cmds)
+	assert.Nil(t, err)
+	assert.Equal(t, deps, [][]int{nil, nil, {0, 1}})
+	results = schedule(context.Background(), cmds, len(cmds), run)
+	assert.Equal(t, names(results), []string{"drain", "shift"})
+	assert.ElementsMatch(t, ran, []string{"drain", "shift"})
+
+	// explicit dependencies and parallel groups
+	ran = nil
+	cmds = []Command{
+		{Name: "check_a"},
+		{Name: "check_b", Parallel: true},
+		{Name: "drain", DependsOn: []string{"check_a", "check_b"}},
+		{Name: "notify", DependsOn: []string{"verify"}},
+		{Name: "verify", DependsOn: []string{"drain"}},
+		{Name: "cleanup", DependsOn: []string{"check_b"}, Command: "fail"},
+	}
+	results = schedule(context.Background(), cmds, len(cmds), run)
+	assert.Equal(t, names(results), []string{"check_a", "check_b", "drain", "verify", "notify", "cleanup"})
+	assert.ElementsMatch(t, ran, names(results))
+
+	// retries
+	attempts := 0
+	flaky := func(ctx context.Context, cmd *Command) *CmdResult {
+		attempts++
+		if attempts < 3 {
+			return &CmdResult{Command: cmd, RetCode: 2, Failure: FailureExitNonZero}
+		}
+		return &CmdResult{Command: cmd}
+	}
+	cmds = []Command{{Name: "drain", Retries: 3, RetryBackoff: time.Millisecond, RetryOn: []string{"2", "timeout"}}}
+	results = schedule(context.Background(), cmds, 1, flaky)
+	assert.Equal(t, len(results), 3)
+	assert.Equal(t, results[2].Attempt, 3)
+	assert.False(t, results[2].Failed())
+
+	attempts = 0
+	cmds[0].RetryOn = []string{"timeout"}
+	results = schedule(context.Background(), cmds, 1, flaky)
+	assert.Equal(t, len(results), 1)
+
+	// exit codes also match scripts that exit with them after reporting they did not pass
+	attempts = 0
+	notPassed := func(ctx context.Context, cmd *Command) *CmdResult {
+		attempts++
+		return &CmdResult{Command: cmd, RetCode: 1, Failure: FailureNotPassed}
+	}
+	cmds[0].RetryOn = []string{"1"}
+	results = schedule(context.Background(), cmds, 1, notPassed)
+	assert.Equal(t, len(results), 4)
+	attempts = 0
+	cmds[0].RetryOn = []string{"2"}
+	results = schedule(context.Background(), cmds, 1, notPassed)
+	assert.Equal(t, len(results), 1)
+
+	attempts = 0
+	cmds[0].RetryOn = nil
+	cmds[0].Retries = 1
+	results = schedule(context.Background(), cmds, 1, flaky)
+	assert.Equal(t, len(results), 2)
+	assert.True(t, results[1].Failed())
+
+	// rejected steps and steps that cannot be rendered are not retried
+	for _, failure := range []Failure{FailureRejected, FailureTemplate, FailureSecret, FailureCancelled} {
+		attempts = 0
+		failing := func(ctx context.Context, cmd *Command) *CmdResult {
+			attempts++
+			return &CmdResult{Command: cmd, Error: fmt.Errorf("failed"), Failure: failure}
+		}
+		results = schedule(context.Background(), []Command{{Name: "drain", Retries: 2, RetryBackoff: time.Millisecond}}, 1, failing)
+		assert.Equal(t, len(results), 1)
+		assert.Equal(t, attempts, 1)
+	}
+
+	assert.Error(t, ValidateSteps([]Command{{Name: "a", RetryOn: []string{"sometimes"}}}))
+	assert.Nil(t, ValidateSteps([]Command{{Name: "a", Retries: 2, RetryOn: []string{"1", "bad_output"}}}))
+
+	// invalid graphs
+	assert.Error(t, ValidateSteps([]Command{{Name: "a", DependsOn: []string{"b"}}, {Name: "b", DependsOn: []string{"a"}}}))
+	assert.Error(t, ValidateSteps([]Command{{Name: "a", DependsOn: []string{"c"}}}))
+	assert.Error(t, ValidateSteps([]Command{{Name: "a"}, {Name: "a"}}))
+	assert.Nil(t, ValidateSteps(cmds))
+	results = schedule(context.Background(), []Command{{Name: "a", DependsOn: []string{"a"}}}, 1, run)
+	assert.Equal(t, len(results), 1)
+	assert.NotNil(t, results[0].Error)
+}
+
+func TestDryRun(t *testing.T) {
+	var args [][]string
+	run := withDryRun(func(ctx context.Context, cmd *Command) *CmdResult {
+		args = append(args, cmd.Args)
+		return &CmdResult{Command: cmd}
+	})
+	cmds := []Command{
+		{Name: "drain", Command: "runner.py", Args: []string{"--script_name", "drain"}, DryRun: true},
+		{Name: "verify", Command: "runner.py", Args: []string{"--script_name", "verify"}, DryRun: true, SupportsDryRun: true},
+		{Name: "notify", Command: "runner.py"},
+	}
+	results := schedule(context.Background(), cmds, len(cmds), run)
+	assert.Equal(t, len(results), 3)
+	assert.Equal(t, args, [][]string{{"--script_name", "verify", DryRunFlag, "true"}, nil})
+	assert.Equal(t, results[0].Message(), "Dry run, skipped drain: runner.py --script_name drain")
+	assert.False(t, results[0].Failed())
+	assert.Equal(t, results[1].Command, &cmds[1])
+	assert.Equal(t, cmds[1].Args, []string{"--script_name", "verify"})
+}
+
+func TestTemplates(t *testing.T) {
+	var ran []*Command
+	run := withTemplates(func(ctx context.Context, cmd *Command) *CmdResult {
+		ran = append(ran, cmd)
+		return &CmdResult{Command: cmd}
+	})
+	inc := &Incident{Name: "BB Link Errors", Id: 10, Data: map[string]interface{}{"device": "d1", "entity": "xe-0/0/0"}}
+	cmd := &Command{
+		Input: inc,
+		Name:  "Drain Link",
+		Args:  []string{"--device", "{{.Data.device}}", "--interface={{.Data.entity}}", "--incident", "{{.Id}}"},
+		Env:   []string{"DEVICE={{.Data.device}}"},
+	}
+	res := run(context.Background(), cmd)
+	assert.False(t, res.Failed())
+	assert.Equal(t, res.Command, cmd)
+	assert.Equal(t, res.Args, []string{"--device", "d1", "--interface=xe-0/0/0", "--incident", "10"})
+	assert.Equal(t, res.Env, []string{"DEVICE=d1"})
+	assert.Equal(t, ran[0].Args, res.Args)
+	assert.Equal(t, cmd.Args[1], "{{.Data.device}}")
+
+	// missing keys fail the step without running it
+	cmd.Args = []string{"--site", "{{.Data.site}}"}
+	res = run(context.Background(), cmd)
+	assert.True(t, res.Failed())
+	assert.Equal(t, res.Failure, FailureTemplate)
+	assert.Contains(t, res.Error.Error(), `Failed to render arg "{{.Data.site}}" of cmd Drain Link`)
+	cmd.Args = []string{"{{.Data.device"}
+	res = run(context.Background(), cmd)
+	assert.Equal(t, res.Failure, FailureTemplate)
+	assert.Equal(t, len(ran), 1)
+}
+
+func TestRunners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "bin"), 0755)
+	script := "#!/bin/sh\ninput=$(cat)\necho \"{\\\"passed\\\": true, \\\"message\\\": \\\"checked $1\\\", \\\"data\\\": {\\\"input\\\": $input}}\"\n"
+	ioutil.WriteFile(filepath.Join(dir, "bin", "check.sh"), []byte(script), 0755)
+	exe := &Executor{scriptsPath: dir}
+	cmds := []Command{
+		{Input: &Incident{Name: "exec"}, Name: "Exec", Runner: RunnerExec, Command: "bin/check.sh", Args: []string{"xe-0/0/0"}},
+		{Input: &Incident{Name: "shell"}, Name: "Shell", Runner: RunnerShell, Command: `cat > /dev/null; echo "{\"passed\": $1}"`, Args: []string{"false"}},
+	}
+	results := exe.Execute(context.Background(), cmds, 2)
+	assert.Equal(t, len(results), 2)
+	assert.False(t, results[0].Failed())
+	assert.Equal(t, results[0].Message(), "checked xe-0/0/0")
+	assert.Equal(t, results[0].Result.Data["input"].(map[string]interface{})["name"], "exec")
+	assert.True(t, results[1].Failed())
+	assert.Equal(t, results[1].Failure, FailureNotPassed)
+
+	// executables outside of the bundle cannot be run
+	cmds = []Command{{Name: "Escape", Runner: RunnerExec, Command: "../../../bin/sh"}}
+	res := exe.Execute(context.Background(), cmds, 1)[0]
+	assert.Equal(t, res.Failure, FailureNotFound)
+
+	assert.Error(t, ValidateSteps([]Command{{Name: "Bad", Runner: "perl"}}))
+	assert.Nil(t, ValidateSteps(cmds))
+}
+
+func TestHTTPRunner(t *testing.T) {
+	var polls int
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/check":
+			i := Incident{}
+			if err := json.NewDecoder(r.Body).Decode(&i); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"passed": true, "message": "checked %s", "data": {"dry_run": %q}}`, i.Name, r.Header.Get(DryRunHeader))
+		case "/broken":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		case "/jobs":
+			assert.Equal(t, r.Header.Get("Authorization"), "Bearer foo")
+			fmt.Fprintf(w, `{"id": "job-%s"}`, r.URL.Query().Get("result"))
+		case "/jobs/job-success", "/jobs/job-failed":
+			mu.Lock()
+			polls++
+			mu.Unlock()
+			if polls%2 == 1 {
+				fmt.Fprint(w, `{"status": "running"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"status": "%s", "message": "job done"}`, strings.TrimPrefix(r.URL.Path, "/jobs/job-"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	job := &HTTPJob{
+		Headers:      map[string]string{"Authorization": "Bearer foo"},
+		StatusURL:    ts.URL + "/jobs/{{.id}}",
+		PollInterval: 10 * time.Millisecond,
+	}
+	exe := &Executor{}
+	cmds := []Command{
+		{Input: &Incident{Name: "link"}, Name: "Check", Runner: RunnerHTTP, Command: ts.URL + "/check"},
+		{Input: &Incident{}, Name: "Broken", Runner: RunnerHTTP, Command: ts.URL + "/broken", Parallel: true},
+		{Input: &Incident{}, Name: "Job", Runner: RunnerHTTP, Command: ts.URL + "/jobs?result=success", HTTP: job, Parallel: true},
+		{Input: &Incident{}, Name: "Failed Job", Runner: RunnerHTTP, Command: ts.URL + "/jobs?result=failed", HTTP: job, DependsOn: []string{"Job"}},
+	}
+	results := exe.Execute(context.Background(), cmds, 4)
+	assert.Equal(t, len(results), 4)
+	byName := make(map[string]*CmdResult)
+	for _, res := range results {
+		byName[res.Command.Name] = res
+	}
+	res := byName["Check"]
+	assert.False(t, res.Failed())
+	assert.Equal(t, res.Message(), "checked link")
+	assert.False(t, res.StartTime.IsZero())
+
+	res = byName["Broken"]
+	assert.True(t, res.Failed())
+	assert.Equal(t, res.RetCode, http.StatusInternalServerError)
+	assert.Equal(t, res.Failure, FailureExitNonZero)
+
+	res = byName["Job"]
+	assert.False(t, res.Failed())
+	assert.Equal(t, res.Message(), "job done")
+
+	res = byName["Failed Job"]
+	assert.True(t, res.Failed())
+	assert.Equal(t, res.Failure, FailureNotPassed)
+
+	// requests of commands in dry run mode carry the dry run header
+	cmds = []Command{{Input: &Incident{}, Name: "Check", Runner: RunnerHTTP, Command: ts.URL + "/check", SupportsDryRun: true, DryRun: true}}
+	res = exe.Execute(context.Background(), cmds, 1)[0]
+	assert.Equal(t, res.Result.Data["dry_run"], "true")
+
+	// jobs that dont complete time out
+	cmds = []Command{{Input: &Incident{}, Name: "Slow", Runner: RunnerHTTP, Command: ts.URL + "/jobs?result=success", Timeout: 50 * time.Millisecond,
+		HTTP: &HTTPJob{Headers: job.Headers, StatusURL: job.StatusURL, PollInterval: time.Second}}}
+	res = exe.Execute(context.Background(), cmds, 1)[0]
+	assert.Equal(t, res.Failure, FailureTimeout)
+
+	assert.Error(t, ValidateSteps([]Command{{Name: "No URL", Runner: RunnerHTTP}}))
+}
+
+type nopAck struct{}
+
+func (nopAck) Ack(tag uint64, multiple bool) error                { return nil }
+func (nopAck) Nack(tag uint64, multiple bool, requeue bool) error { return nil }
+func (nopAck) Reject(tag uint64, requeue bool) error              { return nil }
+
+// memBroker is an in-memory stand-in for the AMQP server
+type memBroker struct {
+	queues map[string]chan amqp.Delivery
+	sync.Mutex
+}
+
+func (b *memBroker) get(queue string) chan amqp.Delivery {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.queues[queue]; !ok {
+		b.queues[queue] = make(chan amqp.Delivery, 100)
+	}
+	return b.queues[queue]
+}
+
+func (b *memBroker) Consume(queue string, prefetch int) (string, <-chan amqp.Delivery, error) {
+	if queue == "" {
+		queue = "reply"
+	}
+	return queue, b.get(queue), nil
+}
+
+func (b *memBroker) Publish(queue string, msg amqp.Publishing) error {
+	b.get(queue) <- amqp.Delivery{
+		Acknowledger:  nopAck{},
+		Type:          msg.Type,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		AppId:         msg.AppId,
+		Headers:       msg.Headers,
+		Body:          msg.Body,
+	}
+	return nil
+}
+
+func (b *memBroker) Close() error { return nil }
+
+func TestRemoteExecution(t *testing.T) {
+	b := &memBroker{queues: make(map[string]chan amqp.Delivery)}
+	opts := RemoteOptions{DefaultRegion: "east", HeartbeatInterval: 20 * time.Millisecond, HeartbeatTimeout: 200 * time.Millisecond}
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the worker and the remote executor don't share their artifact stores
+	local, workerStore := NewArtifactStore(filepath.Join(dir, "local")), NewArtifactStore(filepath.Join(dir, "worker"))
+	remote, err := newRemoteExecutor(opts, local, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	worker := newWorker("east", 2, opts, &Executor{artifacts: workerStore, maxOutput: 128}, b)
+	go worker.Run(ctx)
+
+	logs := NewLogBuffer(0)
+	incident := &Incident{Name: "link", Data: map[string]interface{}{"region": "east"}}
+	cmds := []Command{
+		{Input: incident, Name: "Check", Runner: RunnerShell, Region: "{{.Data.region}}", Logs: logs,
+			Command: `cat > /dev/null; echo checking $1; echo '{"passed": true, "message": "all good"}'`, Args: []string{"xe-0/0/0"}},
+		{Input: incident, Name: "Fail", Runner: RunnerShell, Command: "exit 3", Parallel: true},
+		{Input: incident, Name: "Slow", Runner: RunnerShell, Command: "sleep 5", Timeout: 100 * time.Millisecond, Parallel: true},
+		{Input: incident, Name: "Elsewhere", Runner: RunnerShell, Command: "true", Region: "west", Parallel: true},
+		{Input: incident, Name: "Wait", Type: CmdTypeGo, Command: "wait", Args: []string{"--duration=1ms"}, Region: "west", Parallel: true},
+		{Input: incident, Name: "Artifacts", Runner: RunnerShell, Parallel: true,
+			Command: `cat > /dev/null; echo show output > $AR_ARTIFACTS_DIR/show.txt; seq 100`},
+		{Input: incident, Name: "No Site", Runner: RunnerShell, Command: "true", Region: "{{.Data.site}}", Parallel: true},
+	}
+	results := remote.Execute(ctx, cmds, 7)
+	assert.Equal(t, len(results), 7)
+	byName := make(map[string]*CmdResult)
+	for _, res := range results {
+		byName[res.Command.Name] = res
+	}
+	res := byName["Check"]
+	assert.False(t, res.Failed())
+	assert.Equal(t, res.Message(), "all good")
+	assert.Equal(t, res.Args, []string{"xe-0/0/0"})
+	assert.False(t, res.StartTime.IsZero())
+	lines, _, _ := logs.Subscribe()
+	assert.Equal(t, lines[0].Line, "checking xe-0/0/0")
+
+	res = byName["Fail"]
+	assert.Equal(t, res.RetCode, 3)
+	assert.Equal(t, res.Failure, FailureExitNonZero)
+
+	res = byName["Slow"]
+	assert.Equal(t, res.Failure, FailureTimeout)
+	assert.Error(t, res.Error)
+
+	res = byName["Elsewhere"]
+	assert.Equal(t, res.Failure, FailureWorker)
+	assert.Contains(t, res.Error.Error(), "No worker in region west")
+
+	// go actions run in this process even if no worker is in their region
+	res = byName["Wait"]
+	assert.False(t, res.Failed())
+	assert.Equal(t, res.Message(), "Waited for 1ms")
+
+	// incidents without the fields of a templated region run in the default region
+	res = byName["No Site"]
+	assert.False(t, res.Failed())
+
+	// artifacts of the worker are sent back to the store of the remote executor
+	res = byName["Artifacts"]
+	assert.False(t, res.Failed())
+	assert.Equal(t, len(res.Artifacts), 1)
+	stdout, _ := local.Path(res.StdoutArtifact)
+	_, err = os.Stat(stdout)
+	assert.Nil(t, err)
+	show, _ := local.Path(res.Artifacts[0].Path)
+	data, _ := ioutil.ReadFile(show)
+	assert.Equal(t, string(data), "show output\n")
+}
+
+func TestResultCache(t *testing.T) {
+	var (
+		runs int
+		mu   sync.Mutex
+	)
+	run := newResultCache().wrap(func(ctx context.Context, cmd *Command) *CmdResult {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		if cmd.Args[0] == "broken" {
+			return &CmdResult{Command: cmd, Failure: FailureTimeout, Error: fmt.Errorf("timed out")}
+		}
+		return &CmdResult{Command: cmd, Result: &Result{Passed: passed(true), Message: "link ok"}}
+	})
+	aggregate := &Incident{Name: "Agg", IsAggregate: true, Data: map[string]interface{}{
+		"components": []map[string]interface{}{{"device": "d1", "entity": "e1"}},
+	}}
+	component := &Incident{Name: "Link", Data: map[string]interface{}{"device": "d1", "entity": "e1"}}
+	other := &Incident{Name: "Link", Data: map[string]interface{}{"device": "d2", "entity": "e1"}}
+	audit := Command{Name: "Link Checker", Command: "link_checker", Args: []string{"--check"}, Cacheable: true, CacheTTL: time.Second, Parallel: true}
+	cmds := make([]Command, 4)
+	for i, input := range []*Incident{aggregate, component, component, other} {
+		cmds[i] = audit
+		cmds[i].Name = fmt.Sprintf("%s %d", audit.Name, i)
+		cmds[i].Input = input
+	}
+	results := schedule(context.Background(), cmds, len(cmds), run)
+	assert.Equal(t, runs, 2)
+	var cached int
+	for _, res := range results {
+		assert.False(t, res.Failed())
+		assert.Equal(t, res.Message(), "link ok")
+		if res.Cached {
+			cached++
+		}
+	}
+	assert.Equal(t, cached, 2)
+
+	// results expire after their ttl
+	cmds[0].CacheTTL = time.Millisecond
+	cmds[1].Input = other
+	results = schedule(context.Background(), cmds[:2], 2, run)
+	assert.True(t, results[0].Cached)
+	assert.True(t, results[1].Cached)
+	time.Sleep(time.Second)
+	results = schedule(context.Background(), cmds[:1], 1, run)
+	assert.False(t, results[0].Cached)
+	assert.Equal(t, runs, 3)
+
+	// failures to run and commands that are not cacheable are not cached
+	cmds = []Command{
+		{Name: "Broken", Args: []string{"broken"}, Cacheable: true, Parallel: true},
+		{Name: "Broken Again", Args: []string{"broken"}, Cacheable: true, Parallel: true},
+		{Name: "Once", Args: []string{"--check"}, Parallel: true},
+		{Name: "Twice", Args: []string{"--check"}, Parallel: true},
+	}
+	results = schedule(context.Background(), cmds, 1, run)
+	assert.Equal(t, runs, 7)
+	for _, res := range results {
+		assert.False(t, res.Cached)
+	}
+
+	// results that did not pass are not cached, so that retries run the command again
+	attempts := 0
+	flaky := newResultCache().wrap(func(ctx context.Context, cmd *Command) *CmdResult {
+		attempts++
+		if attempts == 1 {
+			return &CmdResult{Command: cmd, Result: &Result{Passed: passed(false)}, Failure: FailureNotPassed}
+		}
+		return &CmdResult{Command: cmd, Result: &Result{Passed: passed(true)}}
+	})
+	cmds = []Command{{Name: "Flaky", Args: []string{"--check"}, Cacheable: true, Retries: 2,
+		RetryBackoff: time.Millisecond, RetryOn: []string{"not_passed"}}}
+	results = schedule(context.Background(), cmds, 1, flaky)
+	assert.Equal(t, attempts, 2)
+	assert.Equal(t, len(results), 2)
+	assert.False(t, results[1].Cached)
+	assert.False(t, results[1].Failed())
+	results = schedule(context.Background(), cmds, 1, flaky)
+	assert.Equal(t, attempts, 2)
+	assert.True(t, results[0].Cached)
+}
+
+func TestApproval(t *testing.T) {
+	var ran []string
+	run := withApproval(func(ctx context.Context, cmd *Command) *CmdResult {
+		ran = append(ran, cmd.Name)
+		return &CmdResult{Command: cmd}
+	})
+	approve := func(ctx context.Context, cmd *Command) error {
+		if cmd.Name == "bounce" {
+			return fmt.Errorf("Step %s was not approved", cmd.Name)
+		}
+		return nil
+	}
+	cmds := []Command{
+		{Name: "drain", RequireApproval: true, Approval: approve, Parallel: true},
+		{Name: "bounce", RequireApproval: true, Approval: approve, Parallel: true},
+		{Name: "verify", Parallel: true},
+		{Name: "orphan", RequireApproval: true, Parallel: true},
+		{Name: "dry", RequireApproval: true, DryRun: true, Parallel: true},
+	}
+	results := schedule(context.Background(), cmds, 1, run)
+	assert.Equal(t, len(results), 5)
+	assert.Equal(t, ran, []string{"drain", "verify", "dry"})
+	assert.Equal(t, results[1].Failure, FailureRejected)
+	assert.Equal(t, results[1].Error.Error(), "Step bounce was not approved")
+	assert.Equal(t, results[3].Failure, FailureRejected)
+}
+
 func TestMain(m *testing.M) {
 	if os.Getenv("testme") == "1" {
 		execute()
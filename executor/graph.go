@@ -0,0 +1,184 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+)
+
+type runFunc func(ctx context.Context, cmd *Command) *CmdResult
+
+// stepDeps resolves the dependencies of every command in cmds and returns them
+// by index. Commands run sequentially by default: a command without depends_on
+// waits for the command declared before it, unless it is marked parallel in which
+// case it shares the dependencies of that command and runs alongside it. A command
+// following such a parallel group waits for every member of the group.
+func stepDeps(cmds []Command) ([][]int, error) {
+	byName := make(map[string]int)
+	for i, cmd := range cmds {
+		if cmd.Name == "" {
+			continue
+		}
+		if _, ok := byName[cmd.Name]; ok {
+			return nil, fmt.Errorf("Duplicate step name: %s", cmd.Name)
+		}
+		byName[cmd.Name] = i
+	}
+	deps := make([][]int, len(cmds))
+	var group []int
+	for i, cmd := range cmds {
+		switch {
+		case len(cmd.DependsOn) > 0:
+			for _, name := range cmd.DependsOn {
+				j, ok := byName[name]
+				if !ok {
+					return nil, fmt.Errorf("Step %s depends on unknown step %s", cmd.Name, name)
+				}
+				if j == i {
+					return nil, fmt.Errorf("Step %s depends on itself", cmd.Name)
+				}
+				deps[i] = append(deps[i], j)
+			}
+		case i == 0:
+		case cmd.Parallel:
+			deps[i] = deps[i-1]
+			group = append(group, i)
+			continue
+		default:
+			deps[i] = group
+		}
+		group = []int{i}
+	}
+	return deps, nil
+}
+
+// stepOrder returns a topological order of the command indices, preferring
+// declaration order between independent steps.
+func stepOrder(deps [][]int) ([]int, error) {
+	indegree := make([]int, len(deps))
+	dependents := make([][]int, len(deps))
+	for i, d := range deps {
+		indegree[i] = len(d)
+		for _, j := range d {
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	var order []int
+	done := make([]bool, len(deps))
+	for len(order) < len(deps) {
+		next := -1
+		for i := range deps {
+			if !done[i] && indegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			return nil, fmt.Errorf("Steps contain a dependency cycle")
+		}
+		done[next] = true
+		order = append(order, next)
+		for _, i := range dependents[next] {
+			indegree[i]--
+		}
+	}
+	return order, nil
+}
+
+// ValidateSteps checks that the dependencies between cmds form a valid DAG and that
+// their retry and runner settings are valid.
+func ValidateSteps(cmds []Command) error {
+	for _, cmd := range cmds {
+		if err := validateRetries(cmd); err != nil {
+			return err
+		}
+		if err := validateRunner(cmd); err != nil {
+			return err
+		}
+	}
+	deps, err := stepDeps(cmds)
+	if err != nil {
+		return err
+	}
+	_, err = stepOrder(deps)
+	return err
+}
+
+// schedule runs cmds in dependency order with at most maxParallel commands in flight.
+// Failed steps are retried as configured and steps whose dependencies failed are not run.
+// The results of every attempt of the commands that ran are returned in topological order.
+func schedule(ctx context.Context, cmds []Command, maxParallel int, run runFunc) []*CmdResult {
+	deps, err := stepDeps(cmds)
+	var order []int
+	if err == nil {
+		order, err = stepOrder(deps)
+	}
+	if err != nil {
+		var ret []*CmdResult
+		for i := range cmds {
+			ret = append(ret, failedResult(&cmds[i], FailureStartFailed, fmt.Errorf("Invalid steps: %v", err)))
+		}
+		return ret
+	}
+	if maxParallel <= 0 {
+		maxParallel = len(cmds)
+	}
+	const (
+		pending = iota
+		running
+		passed
+		failed
+		skipped
+	)
+	state := make([]int, len(cmds))
+	results := make([][]*CmdResult, len(cmds))
+	finished := make(chan int)
+	inFlight, remaining := 0, len(cmds)
+	for remaining > 0 {
+		for _, i := range order {
+			if state[i] != pending {
+				continue
+			}
+			ready := true
+			for _, j := range deps[i] {
+				switch state[j] {
+				case failed, skipped:
+					state[i] = skipped
+				case passed:
+					continue
+				}
+				ready = false
+				break
+			}
+			if state[i] == skipped || ctx.Err() != nil {
+				state[i] = skipped
+				remaining--
+				continue
+			}
+			if !ready || inFlight >= maxParallel {
+				continue
+			}
+			state[i] = running
+			inFlight++
+			go func(i int) {
+				results[i] = runWithRetries(ctx, &cmds[i], run)
+				finished <- i
+			}(i)
+		}
+		if inFlight == 0 {
+			// everything left was skipped
+			continue
+		}
+		i := <-finished
+		inFlight--
+		remaining--
+		state[i] = passed
+		if results[i][len(results[i])-1].Failed() {
+			state[i] = failed
+		}
+	}
+	var ret []*CmdResult
+	for _, i := range order {
+		ret = append(ret, results[i]...)
+	}
+	return ret
+}
@@ -0,0 +1,190 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DryRunHeader is set on the requests of http commands that are run in dry run mode
+const DryRunHeader = "X-Dry-Run"
+
+const (
+	defaultPollInterval = 10 * time.Second
+	defaultStatusField  = "status"
+)
+
+var (
+	jobSucceeded = []string{"success", "succeeded", "successful", "completed", "done", "passed"}
+	jobFailed    = []string{"failure", "failed", "error", "errored", "cancelled", "canceled"}
+)
+
+// HTTPJob configures commands that are run with RunnerHTTP
+type HTTPJob struct {
+	Headers map[string]string `json:",omitempty"`
+	// StatusURL is polled until the job started by the POST completes. It is a text/template
+	// rendered against the JSON response of the POST, e.g. http://jobs/api/jobs/{{.id}}
+	StatusURL    string        `json:",omitempty" yaml:"status_url"`
+	PollInterval time.Duration `json:",omitempty" yaml:"poll_interval"`
+	// StatusField is the field of the status response holding the state of the job
+	StatusField string `json:",omitempty" yaml:"status_field"`
+}
+
+func in(elem string, list []string) bool {
+	for _, e := range list {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// request runs an http request, returning the response body. Responses with a status
+// other than 2xx are returned as an error result.
+func (e *Executor) request(ctx context.Context, cmd *Command, method, url string, body []byte) ([]byte, *CmdResult) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, failedResult(cmd, FailureStartFailed, fmt.Errorf("Invalid request for cmd %s: %v", cmd.Name, err))
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cmd.DryRun {
+		req.Header.Set(DryRunHeader, "true")
+	}
+	if cmd.HTTP != nil {
+		for k, v := range cmd.HTTP.Headers {
+			req.Header.Set(k, v)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		return nil, failedResult(cmd, FailureStartFailed, fmt.Errorf("Request %s %s failed: %v", method, url, err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		return nil, failedResult(cmd, FailureStartFailed, fmt.Errorf("Failed to read response of %s %s: %v", method, url, err))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &CmdResult{
+			Command: cmd,
+			RetCode: resp.StatusCode,
+			Stdout:  string(data),
+			Failure: FailureExitNonZero,
+			Error:   fmt.Errorf("Request %s %s returned %s", method, url, resp.Status),
+		}
+	}
+	return data, nil
+}
+
+// runHTTP POSTs the incident to the URL of the command and, if the command has a status
+// URL, polls it until the job it started completes. The HTTP status and the job outcome
+// are mapped into the result: non-2xx responses fail with the status code as RetCode.
+func (e *Executor) runHTTP(ctx context.Context, cmd *Command) *CmdResult {
+	startTime := time.Now()
+	res := e.http(ctx, cmd)
+	if err := ctx.Err(); err != nil && res.Error == nil {
+		res.Failure = FailureCancelled
+		if err == context.DeadlineExceeded {
+			res.Failure = FailureTimeout
+		}
+		res.Error = fmt.Errorf("Cmd %s did not finish: %v", cmd.Name, err)
+	}
+	res.Command = cmd
+	res.StartTime, res.EndTime = startTime, time.Now()
+	res.Runtime = res.EndTime.Sub(res.StartTime)
+	res.classify()
+	return res
+}
+
+func (e *Executor) http(ctx context.Context, cmd *Command) *CmdResult {
+	body, err := json.Marshal(cmd.Input)
+	if err != nil {
+		return failedResult(cmd, FailureStartFailed, fmt.Errorf("Unable to marshal incident for cmd %s: %v", cmd.Name, err))
+	}
+	data, res := e.request(ctx, cmd, "POST", cmd.Command, body)
+	if res != nil || ctx.Err() != nil {
+		if res == nil {
+			res = &CmdResult{}
+		}
+		return res
+	}
+	if cmd.HTTP == nil || cmd.HTTP.StatusURL == "" {
+		return e.httpResult(data, nil)
+	}
+	job := make(map[string]interface{})
+	if err := json.Unmarshal(data, &job); err != nil {
+		return &CmdResult{Stdout: string(data), Failure: FailureBadOutput, Error: fmt.Errorf("Invalid job response: %v", err)}
+	}
+	statusURL, err := render(cmd.HTTP.StatusURL, job)
+	if err != nil {
+		return &CmdResult{Stdout: string(data), Failure: FailureBadOutput, Error: fmt.Errorf("Failed to render status url: %v", err)}
+	}
+	interval, field := cmd.HTTP.PollInterval, cmd.HTTP.StatusField
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	if field == "" {
+		field = defaultStatusField
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return &CmdResult{Stdout: string(data)}
+		case <-time.After(interval):
+		}
+		data, res = e.request(ctx, cmd, "GET", statusURL, nil)
+		if res != nil || ctx.Err() != nil {
+			if res == nil {
+				res = &CmdResult{}
+			}
+			return res
+		}
+		status := make(map[string]interface{})
+		if err := json.Unmarshal(data, &status); err != nil {
+			return &CmdResult{Stdout: string(data), Failure: FailureBadOutput, Error: fmt.Errorf("Invalid job status: %v", err)}
+		}
+		state := strings.ToLower(fmt.Sprintf("%v", status[field]))
+		switch {
+		case in(state, jobSucceeded):
+			return e.httpResult(data, passed(true))
+		case in(state, jobFailed):
+			return e.httpResult(data, passed(false))
+		}
+	}
+}
+
+// httpResult maps a response body into a result. Bodies are parsed as result envelopes,
+// jobs that dont report whether they passed get the outcome of the job.
+func (e *Executor) httpResult(data []byte, outcome *bool) *CmdResult {
+	res := &CmdResult{Stdout: string(data)}
+	result, err := parseResult(res.Stdout)
+	if err != nil {
+		res.Failure = FailureBadOutput
+		res.Error = fmt.Errorf("Invalid result: %v", err)
+		return res
+	}
+	if outcome != nil {
+		if result == nil {
+			result = &Result{Version: ResultVersion}
+		}
+		if result.Passed == nil {
+			result.Passed = outcome
+		}
+	}
+	res.Result = result
+	return res
+}
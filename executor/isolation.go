@@ -0,0 +1,89 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Isolation configures how a script command is isolated from the daemon and the host
+type Isolation struct {
+	// TempDir runs the command from a fresh temp dir that is removed once it finishes
+	TempDir bool `json:",omitempty" yaml:"temp_dir"`
+	// EnvAllowlist are the names of the env vars of the daemon that are passed on to the
+	// command, in addition to its own Env. The whole env is passed on if it is not set.
+	EnvAllowlist []string `json:",omitempty" yaml:"env_allowlist"`
+	// Uid and Gid run the command as an unprivileged user, the daemon needs to run as root
+	Uid int `json:",omitempty"`
+	Gid int `json:",omitempty"`
+	// CPUTime, MaxMemory (bytes of address space) and MaxOpenFiles set the rlimits of the command
+	CPUTime      time.Duration `json:",omitempty" yaml:"cpu_time"`
+	MaxMemory    int64         `json:",omitempty" yaml:"max_memory"`
+	MaxOpenFiles int           `json:",omitempty" yaml:"max_open_files"`
+}
+
+// env returns the env to run a command with, given its own env. The env vars of the daemon
+// that are secret are never passed on.
+func (i *Isolation) env(cmdEnv []string, secret func(name string) bool) []string {
+	if i == nil || i.EnvAllowlist == nil {
+		if len(cmdEnv) > 0 {
+			return append([]string{}, cmdEnv...)
+		}
+		var env []string
+		for _, kv := range os.Environ() {
+			if !secret(strings.SplitN(kv, "=", 2)[0]) {
+				env = append(env, kv)
+			}
+		}
+		return env
+	}
+	var env []string
+	for _, name := range i.EnvAllowlist {
+		if val, ok := os.LookupEnv(name); ok && !secret(name) {
+			env = append(env, name+"="+val)
+		}
+	}
+	return append(env, cmdEnv...)
+}
+
+// credential returns the credential to run the command as, if any
+func (i *Isolation) credential() *syscall.Credential {
+	if i == nil || (i.Uid == 0 && i.Gid == 0) {
+		return nil
+	}
+	return &syscall.Credential{Uid: uint32(i.Uid), Gid: uint32(i.Gid)}
+}
+
+// chown gives the user the command runs as ownership of the dir path
+func (i *Isolation) chown(path string) error {
+	if i.credential() == nil {
+		return nil
+	}
+	return os.Chown(path, i.Uid, i.Gid)
+}
+
+// wrap returns the command line to run path with, applying the rlimits through the shell
+// so that they are in place before the command starts.
+func (i *Isolation) wrap(path string, args []string) (string, []string) {
+	if i == nil {
+		return path, args
+	}
+	var limits []string
+	if i.CPUTime > 0 {
+		secs := int64((i.CPUTime + time.Second - 1) / time.Second)
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", secs))
+	}
+	if i.MaxMemory > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", (i.MaxMemory+1023)/1024))
+	}
+	if i.MaxOpenFiles > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -n %d", i.MaxOpenFiles))
+	}
+	if len(limits) == 0 {
+		return path, args
+	}
+	script := strings.Join(limits, " && ") + ` && exec "$0" "$@"`
+	return "/bin/sh", append([]string{"-c", script, path}, args...)
+}
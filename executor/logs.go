@@ -0,0 +1,129 @@
+package executor
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxLogLines = 10000
+	subscriberBuffer   = 256
+)
+
+// LogLine is a single line of output from a running command
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Stream  string    `json:"stream"`
+	Line    string    `json:"line"`
+}
+
+// LogBuffer holds the most recent output lines of the commands run for a remediation
+// and fans new lines out to subscribers as they are produced.
+type LogBuffer struct {
+	lines    []LogLine
+	maxLines int
+	subs     map[chan LogLine]struct{}
+	closed   bool
+	sync.Mutex
+}
+
+func NewLogBuffer(maxLines int) *LogBuffer {
+	if maxLines <= 0 {
+		maxLines = defaultMaxLogLines
+	}
+	return &LogBuffer{maxLines: maxLines, subs: make(map[chan LogLine]struct{})}
+}
+
+// Add appends a line to the buffer. Subscribers that are not keeping up miss the line.
+func (b *LogBuffer) Add(line LogLine) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.maxLines {
+		b.lines = b.lines[len(b.lines)-b.maxLines:]
+	}
+	for sub := range b.subs {
+		select {
+		case sub <- line:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the lines buffered so far and a channel on which new lines are sent.
+// The channel is closed when the buffer is closed or the returned cancel func is called.
+func (b *LogBuffer) Subscribe() ([]LogLine, <-chan LogLine, func()) {
+	b.Lock()
+	defer b.Unlock()
+	backlog := make([]LogLine, len(b.lines))
+	copy(backlog, b.lines)
+	sub := make(chan LogLine, subscriberBuffer)
+	if b.closed {
+		close(sub)
+		return backlog, sub, func() {}
+	}
+	b.subs[sub] = struct{}{}
+	cancel := func() {
+		b.Lock()
+		defer b.Unlock()
+		if _, ok := b.subs[sub]; ok {
+			delete(b.subs, sub)
+			close(sub)
+		}
+	}
+	return backlog, sub, cancel
+}
+
+// Close marks the end of the output and closes all subscriber channels
+func (b *LogBuffer) Close() {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subs {
+		close(sub)
+		delete(b.subs, sub)
+	}
+}
+
+// Closed returns true once the buffer has been closed
+func (b *LogBuffer) Closed() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.closed
+}
+
+// readLines copies r into out line by line as it is produced, streaming each line to
+// the log buffer of the command if it has one. Secrets are redacted from lines if redact is set.
+func readLines(r io.Reader, out io.Writer, cmd *Command, stream string, redact *strings.Replacer) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if redact != nil {
+				line = redact.Replace(line)
+			}
+			io.WriteString(out, line)
+			if cmd.Logs != nil {
+				cmd.Logs.Add(LogLine{
+					Time:    time.Now(),
+					Command: cmd.Name,
+					Stream:  stream,
+					Line:    strings.TrimRight(line, "\r\n"),
+				})
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+const defaultMaxOutputSize = 64 * 1024
+
+// capture holds the output of a stream of a command up to max bytes. Once the output
+// grows past that, the full output is spilled to an artifact and only the head and
+// the tail of it are kept, so that the result envelope on the last line can still be
+// parsed from the truncated output.
+type capture struct {
+	max    int
+	cmd    string
+	stream string
+	store  *ArtifactStore
+	head   bytes.Buffer
+	tail   []byte
+	total  int
+	spill  *os.File
+	path   string
+	err    error
+}
+
+func newCapture(max int, store *ArtifactStore, cmd, stream string) *capture {
+	if max <= 0 {
+		max = defaultMaxOutputSize
+	}
+	return &capture{max: max, store: store, cmd: cmd, stream: stream}
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	overflowed := c.truncated()
+	c.total += len(p)
+	if !c.truncated() {
+		return c.head.Write(p)
+	}
+	if !overflowed {
+		buffered := append([]byte(nil), c.head.Bytes()...)
+		c.head.Reset()
+		if c.store != nil {
+			c.spill, c.path, c.err = c.store.Create(c.cmd, c.stream+".log")
+			c.write(buffered)
+		}
+		c.keep(buffered)
+	}
+	c.write(p)
+	c.keep(p)
+	return len(p), nil
+}
+
+// write writes p to the spilled output
+func (c *capture) write(p []byte) {
+	if c.spill != nil && c.err == nil {
+		_, c.err = c.spill.Write(p)
+	}
+}
+
+// keep fills the head with p up to half of max and keeps the rest as the tail
+func (c *capture) keep(p []byte) {
+	if room := c.max/2 - c.head.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.head.Write(p[:room])
+		p = p[room:]
+	}
+	c.tail = append(c.tail, p...)
+	if size := c.max - c.max/2; len(c.tail) > size {
+		c.tail = c.tail[len(c.tail)-size:]
+	}
+}
+
+// truncated returns true if the output did not fit
+func (c *capture) truncated() bool {
+	return c.total > c.max
+}
+
+// String returns the captured output, with a marker in place of the bytes that did not fit
+func (c *capture) String() string {
+	if !c.truncated() {
+		return c.head.String()
+	}
+	marker := fmt.Sprintf("\n... [output truncated, %d of %d bytes omitted", c.total-c.head.Len()-len(c.tail), c.total)
+	if c.path != "" && c.err == nil {
+		marker += fmt.Sprintf(", full output in artifact %s", c.path)
+	}
+	return c.head.String() + marker + "] ...\n" + string(c.tail)
+}
+
+// result returns the output the result envelope is parsed from: all of it if it fit, or
+// else the last line of the tail. An envelope that does not fit in the tail is not kept.
+func (c *capture) result() string {
+	if !c.truncated() {
+		return c.head.String()
+	}
+	tail := bytes.TrimRight(c.tail, " \t\r\n")
+	i := bytes.LastIndexByte(tail, '\n')
+	if i < 0 {
+		return ""
+	}
+	return string(tail[i+1:])
+}
+
+// close closes the spilled output and returns its path in the artifact store, if any
+func (c *capture) close() (string, error) {
+	if c.spill == nil {
+		return "", c.err
+	}
+	if err := c.spill.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.path, nil
+}
@@ -23,6 +23,30 @@ type Incident struct {
 	IsAggregate bool                   `json:"is_aggregate"`
 }
 
+// Entities returns the entities the incident is about, as device:entity if the incident
+// has a device. Aggregate incidents are about the entities of their components.
+func (i Incident) Entities() []string {
+	var entities []string
+	if i.IsAggregate {
+		if components, ok := i.Data["components"]; ok {
+			for _, alertData := range components.([]map[string]interface{}) {
+				if d, ok := alertData["device"]; ok {
+					entities = append(entities, fmt.Sprintf("%v:%v", d, alertData["entity"]))
+				} else {
+					entities = append(entities, fmt.Sprintf("%v", alertData["entity"]))
+				}
+			}
+		}
+	} else {
+		if d, ok := i.Data["device"]; ok {
+			entities = append(entities, fmt.Sprintf("%v:%v", d, i.Data["entity"]))
+		} else {
+			entities = append(entities, fmt.Sprintf("%v", i.Data["entity"]))
+		}
+	}
+	return entities
+}
+
 type IncidentQueue interface {
 	Register(chan Incident)
 	Shutdown() error
@@ -0,0 +1,506 @@
+package executor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultQueuePrefix       = "auto_remediation.commands"
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultHeartbeatTimeout  = 60 * time.Second
+
+	msgHeartbeat = "heartbeat"
+	msgLog       = "log"
+	msgArtifact  = "artifact"
+	msgResult    = "result"
+)
+
+// RemoteOptions configures running commands on workers over AMQP. Commands are published
+// to the work queue of their region, <queue_prefix>.<region>.
+type RemoteOptions struct {
+	Addr        string
+	User        string
+	Pass        string
+	QueuePrefix string `yaml:"queue_prefix"`
+	// DefaultRegion is the region of commands that dont set one
+	DefaultRegion     string        `yaml:"default_region"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// HeartbeatTimeout fails commands that no worker picked up, or whose worker stopped
+	// sending heartbeats, for this long
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+}
+
+func (o *RemoteOptions) setDefaults() {
+	if o.QueuePrefix == "" {
+		o.QueuePrefix = defaultQueuePrefix
+	}
+	if o.HeartbeatInterval == 0 {
+		o.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if o.HeartbeatTimeout == 0 {
+		o.HeartbeatTimeout = defaultHeartbeatTimeout
+	}
+}
+
+func (o *RemoteOptions) queue(region string) string {
+	return o.QueuePrefix + "." + region
+}
+
+// MarshalJSON encodes the result with its error as a string so that it can be sent
+// by workers
+func (r *CmdResult) MarshalJSON() ([]byte, error) {
+	type result CmdResult
+	var errStr string
+	if r.Error != nil {
+		errStr = r.Error.Error()
+	}
+	return json.Marshal(&struct {
+		*result
+		Error string `json:",omitempty"`
+	}{(*result)(r), errStr})
+}
+
+func (r *CmdResult) UnmarshalJSON(data []byte) error {
+	type result CmdResult
+	aux := &struct {
+		*result
+		Error string `json:",omitempty"`
+	}{result: (*result)(r)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	if aux.Error != "" {
+		r.Error = errors.New(aux.Error)
+	}
+	return nil
+}
+
+// broker is the message transport between remote executors and workers
+type broker interface {
+	// Consume declares queue and returns its messages, which must be acked. If queue is
+	// empty an exclusive queue is declared with a generated name, whose messages are
+	// acked automatically.
+	Consume(queue string, prefetch int) (string, <-chan amqp.Delivery, error)
+	// Publish sends msg to queue through the default exchange
+	Publish(queue string, msg amqp.Publishing) error
+	Close() error
+}
+
+type amqpBroker struct {
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+func dialBroker(addr, user, pass string) (*amqpBroker, error) {
+	uri := fmt.Sprintf("amqp://%s:%s@%s", user, pass, addr)
+	b := &amqpBroker{}
+	var err error
+	if b.conn, err = amqp.Dial(uri); err != nil {
+		return nil, fmt.Errorf("Error dialing amqp server: %v", err)
+	}
+	if b.channel, err = b.conn.Channel(); err != nil {
+		return nil, fmt.Errorf("Error getting amqp channel: %v", err)
+	}
+	return b, nil
+}
+
+func (b *amqpBroker) Consume(queue string, prefetch int) (string, <-chan amqp.Delivery, error) {
+	exclusive := queue == ""
+	q, err := b.channel.QueueDeclare(
+		queue,      // name
+		!exclusive, // durable
+		exclusive,  // delete when unused
+		exclusive,  // exclusive
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error declaring queue: %v", err)
+	}
+	if !exclusive {
+		if err := b.channel.Qos(prefetch, 0, false); err != nil {
+			return "", nil, fmt.Errorf("Error setting prefetch: %v", err)
+		}
+	}
+	msgs, err := b.channel.Consume(
+		q.Name,    // queue
+		"",        // consumer
+		exclusive, // auto-ack
+		exclusive, // exclusive
+		false,     // no-local
+		false,     // no-wait
+		nil,       // args
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to get msg chan : %v", err)
+	}
+	return q.Name, msgs, nil
+}
+
+func (b *amqpBroker) Publish(queue string, msg amqp.Publishing) error {
+	return b.channel.Publish("", queue, false, false, msg)
+}
+
+func (b *amqpBroker) Close() error {
+	return b.conn.Close()
+}
+
+type remoteJob struct {
+	replies chan amqp.Delivery
+	done    chan struct{}
+}
+
+// RemoteExecutor runs commands on the workers of their region instead of locally. The
+// artifacts of the commands are sent back by the workers and kept in artifacts.
+type RemoteExecutor struct {
+	opts      RemoteOptions
+	broker    broker
+	replyTo   string
+	pending   map[string]*remoteJob
+	cache     *resultCache
+	artifacts *ArtifactStore
+	sync.Mutex
+}
+
+func NewRemoteExecutor(opts RemoteOptions, artifacts *ArtifactStore) (*RemoteExecutor, error) {
+	b, err := dialBroker(opts.Addr, opts.User, opts.Pass)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRemoteExecutor(opts, artifacts, b)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	glog.Infof("Running commands on remote workers through AMQP server: %v", opts.Addr)
+	return r, nil
+}
+
+func newRemoteExecutor(opts RemoteOptions, artifacts *ArtifactStore, b broker) (*RemoteExecutor, error) {
+	opts.setDefaults()
+	replyTo, replies, err := b.Consume("", 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &RemoteExecutor{
+		opts:      opts,
+		broker:    b,
+		replyTo:   replyTo,
+		pending:   make(map[string]*remoteJob),
+		cache:     newResultCache(),
+		artifacts: artifacts,
+	}
+	go r.recv(replies)
+	return r, nil
+}
+
+// recv dispatches the replies of workers to the commands waiting on them
+func (r *RemoteExecutor) recv(replies <-chan amqp.Delivery) {
+	for m := range replies {
+		r.Lock()
+		job, ok := r.pending[m.CorrelationId]
+		r.Unlock()
+		if !ok {
+			glog.V(2).Infof("Dropping %s from worker %s for unknown cmd %s", m.Type, m.AppId, m.CorrelationId)
+			continue
+		}
+		select {
+		case job.replies <- m:
+		case <-job.done:
+		}
+	}
+}
+
+func (r *RemoteExecutor) Close() error {
+	return r.broker.Close()
+}
+
+func (r *RemoteExecutor) Execute(ctx context.Context, cmds []Command, maxParallel int) []*CmdResult {
+	return schedule(ctx, cmds, maxParallel, withTemplates(withDryRun(withApproval(r.cache.wrap(r.run)))))
+}
+
+func jobId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// run publishes cmd to the work queue of its region and waits for its result. Commands
+// fail if no worker picks them up or their worker stops sending heartbeats. Go actions
+// are registered in this process only, so they are run locally.
+func (r *RemoteExecutor) run(ctx context.Context, cmd *Command) *CmdResult {
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if cmd.Type == CmdTypeGo {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return runAction(ctx, cmd)
+	}
+	startTime := time.Now()
+	failed := func(failure Failure, err error) *CmdResult {
+		res := failedResult(cmd, failure, err)
+		res.StartTime, res.EndTime = startTime, time.Now()
+		res.Runtime = res.EndTime.Sub(res.StartTime)
+		return res
+	}
+	region := cmd.Region
+	if region == "" {
+		region = r.opts.DefaultRegion
+	}
+	if region == "" {
+		return failed(FailureWorker, fmt.Errorf("Cmd %s has no region to run in", cmd.Name))
+	}
+	// the worker times out the command itself, this only covers a worker that never replies
+	ctx, cancel := context.WithTimeout(ctx, timeout+r.opts.HeartbeatTimeout)
+	defer cancel()
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return failed(FailureWorker, fmt.Errorf("Unable to marshal cmd %s: %v", cmd.Name, err))
+	}
+	id := jobId()
+	job := &remoteJob{replies: make(chan amqp.Delivery), done: make(chan struct{})}
+	r.Lock()
+	r.pending[id] = job
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		delete(r.pending, id)
+		r.Unlock()
+		close(job.done)
+	}()
+	err = r.broker.Publish(r.opts.queue(region), amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: id,
+		ReplyTo:       r.replyTo,
+		// jobs that are not picked up in time have already failed
+		Expiration: strconv.FormatInt(int64(r.opts.HeartbeatTimeout/time.Millisecond), 10),
+		Timestamp:  startTime,
+		Body:       body,
+	})
+	if err != nil {
+		return failed(FailureWorker, fmt.Errorf("Failed to publish cmd %s to region %s: %v", cmd.Name, region, err))
+	}
+	var worker string
+	heartbeat := time.NewTimer(r.opts.HeartbeatTimeout)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			failure := FailureCancelled
+			if ctx.Err() == context.DeadlineExceeded {
+				failure = FailureTimeout
+			}
+			return failed(failure, fmt.Errorf("Cmd %s did not finish on worker %s in region %s: %v", cmd.Name, worker, region, ctx.Err()))
+		case <-heartbeat.C:
+			if worker == "" {
+				return failed(FailureWorker, fmt.Errorf("No worker in region %s picked up cmd %s", region, cmd.Name))
+			}
+			return failed(FailureWorker, fmt.Errorf("Lost worker %s running cmd %s in region %s", worker, cmd.Name, region))
+		case m := <-job.replies:
+			worker = m.AppId
+			if !heartbeat.Stop() {
+				select {
+				case <-heartbeat.C:
+				default:
+				}
+			}
+			heartbeat.Reset(r.opts.HeartbeatTimeout)
+			switch m.Type {
+			case msgLog:
+				line := LogLine{}
+				if err := json.Unmarshal(m.Body, &line); err == nil && cmd.Logs != nil {
+					cmd.Logs.Add(line)
+				}
+			case msgArtifact:
+				// artifacts are sent before the result that refers to them
+				path, _ := m.Headers["path"].(string)
+				if err := r.artifacts.Write(path, m.Body); err != nil {
+					glog.Errorf("Failed to store artifact %s of cmd %s from worker %s: %v", path, cmd.Name, worker, err)
+				}
+			case msgResult:
+				res := &CmdResult{}
+				if err := json.Unmarshal(m.Body, res); err != nil {
+					return failed(FailureWorker, fmt.Errorf("Invalid result of cmd %s from worker %s: %v", cmd.Name, worker, err))
+				}
+				res.Command = cmd
+				return res
+			}
+		}
+	}
+}
+
+// Worker runs the commands that remote executors publish to the work queue of its region
+type Worker struct {
+	name        string
+	region      string
+	concurrency int
+	opts        RemoteOptions
+	exe         *Executor
+	broker      broker
+}
+
+// NewWorker returns a worker that runs up to concurrency commands of region at a time
+// with an executor configured by opts.
+func NewWorker(region string, concurrency int, remote RemoteOptions, opts Options) (*Worker, error) {
+	b, err := dialBroker(remote.Addr, remote.User, remote.Pass)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Connected to AMQP server: %v", remote.Addr)
+	return newWorker(region, concurrency, remote, NewExecutor(opts).(*Executor), b), nil
+}
+
+func newWorker(region string, concurrency int, opts RemoteOptions, exe *Executor, b broker) *Worker {
+	opts.setDefaults()
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	name, _ := os.Hostname()
+	return &Worker{
+		name:        fmt.Sprintf("%s/%d", name, os.Getpid()),
+		region:      region,
+		concurrency: concurrency,
+		opts:        opts,
+		exe:         exe,
+		broker:      b,
+	}
+}
+
+// Run runs commands until ctx is cancelled and then waits for the running commands to finish
+func (w *Worker) Run(ctx context.Context) error {
+	queue, jobs, err := w.broker.Consume(w.opts.queue(w.region), w.concurrency)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Worker %s running commands from %s", w.name, queue)
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m, ok := <-jobs:
+					if !ok {
+						return
+					}
+					w.handle(m)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return w.broker.Close()
+}
+
+func (w *Worker) reply(m amqp.Delivery, typ string, body []byte) {
+	err := w.broker.Publish(m.ReplyTo, amqp.Publishing{
+		ContentType:   "application/json",
+		Type:          typ,
+		CorrelationId: m.CorrelationId,
+		AppId:         w.name,
+		Body:          body,
+	})
+	if err != nil {
+		glog.Errorf("Failed to send %s of cmd %s: %v", typ, m.CorrelationId, err)
+	}
+}
+
+// sendArtifacts sends the spilled output and the artifacts of res, which are on the disk
+// of this worker, to the remote executor
+func (w *Worker) sendArtifacts(m amqp.Delivery, res *CmdResult) {
+	if w.exe.artifacts == nil {
+		return
+	}
+	paths := []string{res.StdoutArtifact, res.StderrArtifact}
+	for _, a := range res.Artifacts {
+		paths = append(paths, a.Path)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		full, err := w.exe.artifacts.Path(path)
+		if err != nil {
+			glog.Errorf("Failed to send artifact %s of cmd %s: %v", path, m.CorrelationId, err)
+			continue
+		}
+		data, err := ioutil.ReadFile(full)
+		if err != nil {
+			glog.Errorf("Failed to send artifact %s of cmd %s: %v", path, m.CorrelationId, err)
+			continue
+		}
+		err = w.broker.Publish(m.ReplyTo, amqp.Publishing{
+			ContentType:   "application/octet-stream",
+			Type:          msgArtifact,
+			CorrelationId: m.CorrelationId,
+			AppId:         w.name,
+			Headers:       amqp.Table{"path": path},
+			Body:          data,
+		})
+		if err != nil {
+			glog.Errorf("Failed to send artifact %s of cmd %s: %v", path, m.CorrelationId, err)
+		}
+	}
+}
+
+// handle runs a command, sending heartbeats and its output while it runs
+func (w *Worker) handle(m amqp.Delivery) {
+	// ack before running so that a command is never run twice, the remote executor fails
+	// it if this worker goes away
+	m.Ack(false)
+	w.reply(m, msgHeartbeat, nil)
+	cmd := &Command{}
+	if err := json.Unmarshal(m.Body, cmd); err != nil {
+		data, _ := json.Marshal(&CmdResult{Failure: FailureWorker, Error: fmt.Errorf("Invalid cmd: %v", err)})
+		w.reply(m, msgResult, data)
+		return
+	}
+	glog.V(2).Infof("Running cmd %s (%s)", cmd.Name, m.CorrelationId)
+	cmd.Logs = NewLogBuffer(0)
+	_, lines, _ := cmd.Logs.Subscribe()
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		ticker := time.NewTicker(w.opts.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				data, _ := json.Marshal(&line)
+				w.reply(m, msgLog, data)
+			case <-ticker.C:
+				w.reply(m, msgHeartbeat, nil)
+			}
+		}
+	}()
+	res := w.exe.run(context.Background(), cmd)
+	cmd.Logs.Close()
+	<-forwarded
+	w.sendArtifacts(m, res)
+	data, err := json.Marshal(res)
+	if err != nil {
+		data, _ = json.Marshal(&CmdResult{Failure: FailureWorker, Error: fmt.Errorf("Unable to marshal result: %v", err)})
+	}
+	w.reply(m, msgResult, data)
+}
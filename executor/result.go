@@ -0,0 +1,55 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ResultVersion is the latest version of the result envelope understood by the executor.
+const ResultVersion = 1
+
+// Result is the structured envelope that scripts print as JSON on stdout.
+// Scripts that predate the envelope omit the version and are treated as version 1.
+type Result struct {
+	Version       int                    `json:"version"`
+	Passed        *bool                  `json:"passed,omitempty"`
+	Message       string                 `json:"message,omitempty"`
+	Data          map[string]interface{} `json:"data,omitempty"`
+	Severity      string                 `json:"severity,omitempty"`
+	SuggestedNext string                 `json:"suggested_next,omitempty"`
+}
+
+// parseResult decodes the result envelope from a command's stdout. The envelope is either
+// the whole of stdout or its last non-empty line. A nil result is returned if stdout
+// does not contain a JSON object.
+func parseResult(stdout string) (*Result, error) {
+	out := strings.TrimSpace(stdout)
+	lines := strings.Split(out, "\n")
+	var (
+		res *Result
+		err error
+	)
+	for _, candidate := range []string{out, strings.TrimSpace(lines[len(lines)-1])} {
+		if !strings.HasPrefix(candidate, "{") {
+			continue
+		}
+		res = &Result{}
+		if err = json.Unmarshal([]byte(candidate), res); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode result: %v", err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+	if res.Version == 0 {
+		res.Version = 1
+	}
+	if res.Version > ResultVersion {
+		return nil, fmt.Errorf("Unsupported result version %d", res.Version)
+	}
+	return res, nil
+}
@@ -0,0 +1,97 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const defaultRetryBackoff = 5 * time.Second
+
+// shouldRetry returns true if the failed result matches the retry_on conditions of the command.
+// Commands without retry_on are retried on any failure, except results that did not pass:
+// those are answers of the command rather than errors, and only retried on not_passed.
+// Cancelled and rejected steps and steps whose args or secrets cannot be resolved are
+// never retried.
+// An exit code in retry_on matches any failure of a command that exited with that code,
+// including a script that exits non zero when it reports that it did not pass.
+func shouldRetry(cmd *Command, res *CmdResult) bool {
+	if !res.Failed() {
+		return false
+	}
+	switch res.Failure {
+	case FailureCancelled, FailureRejected, FailureTemplate, FailureSecret:
+		// running the command again does not change these
+		return false
+	}
+	if len(cmd.RetryOn) == 0 {
+		return res.Failure != FailureNotPassed
+	}
+	for _, cond := range cmd.RetryOn {
+		if code, err := strconv.Atoi(cond); err == nil {
+			if exited(res) && res.RetCode == code {
+				return true
+			}
+			continue
+		}
+		if Failure(cond) == res.Failure {
+			return true
+		}
+	}
+	return false
+}
+
+// exited returns true if the failed result is of a command that ran to its exit
+func exited(res *CmdResult) bool {
+	switch res.Failure {
+	case FailureExitNonZero, FailureNotPassed, FailureBadOutput:
+		return true
+	}
+	return false
+}
+
+// runWithRetries runs cmd up to 1 + cmd.Retries times, backing off exponentially between
+// attempts, and returns the result of every attempt.
+func runWithRetries(ctx context.Context, cmd *Command, run runFunc) []*CmdResult {
+	backoff := cmd.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	var results []*CmdResult
+	for attempt := 1; ; attempt++ {
+		res := run(ctx, cmd)
+		res.Attempt = attempt
+		results = append(results, res)
+		if attempt > cmd.Retries || !shouldRetry(cmd, res) {
+			return results
+		}
+		glog.V(2).Infof("Cmd %s failed (%s) on attempt %d, retrying in %v", cmd.Name, res.Failure, attempt, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return results
+		}
+		backoff *= 2
+	}
+}
+
+func validateRetries(cmd Command) error {
+	if cmd.Retries < 0 {
+		return fmt.Errorf("Step %s has negative retries", cmd.Name)
+	}
+	for _, cond := range cmd.RetryOn {
+		if _, err := strconv.Atoi(cond); err == nil {
+			continue
+		}
+		switch Failure(cond) {
+		case FailureExitNonZero, FailureNotPassed, FailureTimeout, FailureKilledBySignal,
+			FailureStartFailed, FailureNotFound, FailureBadOutput:
+		default:
+			return fmt.Errorf("Step %s has invalid retry_on condition: %s", cmd.Name, cond)
+		}
+	}
+	return nil
+}
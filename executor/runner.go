@@ -0,0 +1,63 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Runners that script commands can be run with
+const (
+	// RunnerPython runs Command as a script of the scripts package through runner.py
+	RunnerPython = "python-runner"
+	// RunnerExec runs Command as an executable in the scripts bundle
+	RunnerExec = "exec"
+	// RunnerShell runs Command with /bin/sh -c, with Args as its positional parameters
+	RunnerShell = "shell"
+	// RunnerHTTP POSTs the incident JSON to the URL in Command, see HTTPJob
+	RunnerHTTP = "http"
+)
+
+func validateRunner(cmd Command) error {
+	// secrets are injected into the env of the process, go actions and http jobs have none
+	if len(cmd.Secrets) > 0 && (cmd.Type == CmdTypeGo || cmd.Runner == RunnerHTTP) {
+		return fmt.Errorf("Step %s has secrets, only steps that run a process can use secrets", cmd.Name)
+	}
+	switch cmd.Runner {
+	case "", RunnerPython, RunnerExec, RunnerShell:
+		return nil
+	case RunnerHTTP:
+		if cmd.Command == "" {
+			return fmt.Errorf("Step %s has no url", cmd.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("Step %s has unknown runner: %s", cmd.Name, cmd.Runner)
+}
+
+// commandLine returns the executable and args that run cmd from the scripts path. All
+// runners are given the incident JSON on stdin.
+func (e *Executor) commandLine(cmd *Command, scriptsPath string) (string, []string, error) {
+	var (
+		path string
+		args []string
+	)
+	switch cmd.Runner {
+	case "", RunnerPython:
+		path = filepath.Join(scriptsPath, runnerCmd)
+		args = []string{"--scripts_path", scriptsPath, "--script_name", cmd.Command, "--common_opts_file", e.commonOpts}
+		args = append(args, cmd.Args...)
+	case RunnerExec:
+		// executables are confined to the scripts bundle
+		path = filepath.Join(scriptsPath, filepath.Clean("/"+cmd.Command))
+		args = cmd.Args
+	case RunnerShell:
+		return "/bin/sh", append([]string{"-c", cmd.Command, cmd.Name}, cmd.Args...), nil
+	default:
+		return "", nil, fmt.Errorf("Unknown runner: %s", cmd.Runner)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("Cmd not found: %s", path)
+	}
+	return path, args, nil
+}
@@ -0,0 +1,73 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+)
+
+// render renders s as a text/template against data, usually the incident
+func render(s string, data interface{}) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Render returns a copy of the command with its Args, Env and Region rendered as text/templates
+// against its Input, e.g. `--device {{.Data.device}}`. A Region that fails to render is left
+// empty so that the command runs in the default region.
+func (c *Command) Render() (*Command, error) {
+	rendered := *c
+	rendered.Args = make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		val, err := render(arg, c.Input)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to render arg %q of cmd %s: %v", arg, c.Name, err)
+		}
+		rendered.Args[i] = val
+	}
+	rendered.Env = make([]string, len(c.Env))
+	for i, env := range c.Env {
+		val, err := render(env, c.Input)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to render env %q of cmd %s: %v", env, c.Name, err)
+		}
+		rendered.Env[i] = val
+	}
+	// commands of incidents without the fields of the region run in the default region
+	region, err := render(c.Region, c.Input)
+	if err != nil {
+		glog.V(2).Infof("Failed to render region of cmd %s, using the default region: %v", c.Name, err)
+		region = ""
+	}
+	rendered.Region = region
+	return &rendered, nil
+}
+
+// withTemplates wraps run so that commands are run with their args and env rendered
+// against the incident. Commands whose templates fail to render are not run.
+func withTemplates(run runFunc) runFunc {
+	return func(ctx context.Context, cmd *Command) *CmdResult {
+		rendered, err := cmd.Render()
+		if err != nil {
+			return failedResult(cmd, FailureTemplate, err)
+		}
+		res := run(ctx, rendered)
+		res.Command = cmd
+		res.Args, res.Env = rendered.Args, rendered.Env
+		return res
+	}
+}
@@ -0,0 +1,243 @@
+package maintenance
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var icsDays = map[string]string{
+	"SU": "sun", "MO": "mon", "TU": "tue", "WE": "wed", "TH": "thu", "FR": "fri", "SA": "sat",
+}
+
+var icsDuration = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// icsProp is a content line of an ICS file, e.g. DTSTART;TZID=Europe/Paris:20190610T220000
+type icsProp struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// readICS returns the properties of each VEVENT of an ICS file
+func readICS(r io.Reader) ([][]icsProp, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// long lines are folded onto lines starting with whitespace
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var events [][]icsProp
+	var event []icsProp
+	inEvent := false
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid line: %s", line)
+		}
+		parts := strings.Split(line[:i], ";")
+		prop := icsProp{name: strings.ToUpper(parts[0]), params: make(map[string]string), value: line[i+1:]}
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) == 2 {
+				prop.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+		switch {
+		case prop.name == "BEGIN" && prop.value == "VEVENT":
+			event, inEvent = nil, true
+		case prop.name == "END" && prop.value == "VEVENT":
+			events = append(events, event)
+			inEvent = false
+		case inEvent:
+			event = append(event, prop)
+		}
+	}
+	return events, nil
+}
+
+// parseICSTime parses a DATE or DATE-TIME value, returning the timezone it is in
+func parseICSTime(p icsProp) (time.Time, string, error) {
+	tz := "Local"
+	if p.params["TZID"] != "" {
+		tz = p.params["TZID"]
+	} else if strings.HasSuffix(p.value, "Z") {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("Unknown timezone %s", tz)
+	}
+	layout := "20060102T150405"
+	if p.params["VALUE"] == "DATE" || len(p.value) == len("20060102") {
+		layout = "20060102"
+	}
+	t, err := time.ParseInLocation(layout, strings.TrimSuffix(p.value, "Z"), loc)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("Invalid %s %s", p.name, p.value)
+	}
+	return t, tz, nil
+}
+
+// parseICSDuration parses a DURATION value such as PT2H30M
+func parseICSDuration(value string) (time.Duration, error) {
+	m := icsDuration.FindStringSubmatch(value)
+	if m == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("Invalid DURATION %s", value)
+	}
+	var d time.Duration
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, unit := range units {
+		if m[i+1] != "" {
+			n, _ := strconv.Atoi(m[i+1])
+			d += time.Duration(n) * unit
+		}
+	}
+	return d, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// eventWindow converts a VEVENT to a window. Recurring events are supported for daily
+// and weekly RRULEs without an interval or count.
+func eventWindow(props []icsProp, scope Scope) (Window, error) {
+	w := Window{Scope: scope}
+	var start, end time.Time
+	var tz, rrule string
+	var duration time.Duration
+	var err error
+	for _, p := range props {
+		switch p.name {
+		case "SUMMARY":
+			w.Name = p.value
+		case "DESCRIPTION":
+			w.Reason = strings.Replace(p.value, `\n`, " ", -1)
+		case "DTSTART":
+			if start, tz, err = parseICSTime(p); err != nil {
+				return w, err
+			}
+		case "DTEND":
+			if end, _, err = parseICSTime(p); err != nil {
+				return w, err
+			}
+		case "DURATION":
+			if duration, err = parseICSDuration(p.value); err != nil {
+				return w, err
+			}
+		case "RRULE":
+			rrule = p.value
+		case "X-AR-RULES":
+			w.Rules = splitList(p.value)
+		case "X-AR-DEVICES":
+			w.Devices = splitList(p.value)
+		case "X-AR-SITES":
+			w.Sites = splitList(p.value)
+		}
+	}
+	if start.IsZero() {
+		return w, fmt.Errorf("Missing DTSTART")
+	}
+	if !end.IsZero() {
+		duration = end.Sub(start)
+	}
+	if duration <= 0 {
+		return w, fmt.Errorf("Missing DTEND or DURATION")
+	}
+	if rrule == "" {
+		w.From, w.To = start, start.Add(duration)
+		return w, nil
+	}
+	w.Start, w.Duration, w.Timezone, w.From = start.Format("15:04"), duration, tz, start
+	freq := ""
+	for _, part := range strings.Split(rrule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "FREQ":
+			freq = kv[1]
+		case "BYDAY":
+			for _, d := range strings.Split(kv[1], ",") {
+				day, ok := icsDays[d]
+				if !ok {
+					return w, fmt.Errorf("Unsupported BYDAY %s", d)
+				}
+				w.Days = append(w.Days, day)
+			}
+		case "UNTIL":
+			until := icsProp{name: "UNTIL", params: make(map[string]string), value: kv[1]}
+			if !strings.HasSuffix(kv[1], "Z") {
+				until.params["TZID"] = tz
+			}
+			if w.To, _, err = parseICSTime(until); err != nil {
+				return w, err
+			}
+			// an UNTIL date includes the occurrence on that day
+			if len(kv[1]) == len("20060102") {
+				w.To = w.To.AddDate(0, 0, 1).Add(-time.Second)
+			}
+		case "INTERVAL":
+			if kv[1] != "1" {
+				return w, fmt.Errorf("Unsupported RRULE %s", rrule)
+			}
+		default:
+			return w, fmt.Errorf("Unsupported RRULE %s", rrule)
+		}
+	}
+	switch freq {
+	case "DAILY":
+	case "WEEKLY":
+		if len(w.Days) == 0 {
+			w.Days = []string{strings.ToLower(start.Weekday().String()[:3])}
+		}
+	default:
+		return w, fmt.Errorf("Unsupported RRULE %s", rrule)
+	}
+	return w, nil
+}
+
+// ParseICS returns the windows of the events of an ICS calendar, in the given scope
+// unless the events set their own. Events that cannot be converted to a window are
+// skipped.
+func ParseICS(r io.Reader, scope Scope) ([]Window, error) {
+	events, err := readICS(r)
+	if err != nil {
+		return nil, err
+	}
+	var windows []Window
+	for _, props := range events {
+		w, err := eventWindow(props, scope)
+		if err != nil {
+			glog.Errorf("Skipping calendar event %s: %v", w.Name, err)
+			continue
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
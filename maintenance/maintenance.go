@@ -0,0 +1,265 @@
+package maintenance
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Config holds the maintenance windows and freezes configured in YAML and the ICS
+// calendars to load more from
+type Config struct {
+	Windows   []Window
+	Calendars []Calendar
+}
+
+// Scope restricts a window to incidents of its rules, of devices matching its device
+// patterns and of its sites. Empty fields match all incidents.
+type Scope struct {
+	Rules []string
+	// Devices are shell patterns as supported by path.Match, e.g. bb*.sjc1
+	Devices []string
+	Sites   []string
+}
+
+// Target is what an incident is about
+type Target struct {
+	Rule    string
+	Devices []string
+	Sites   []string
+}
+
+// Matches returns true if the target is in scope
+func (s Scope) Matches(t Target) bool {
+	if len(s.Rules) > 0 && !contains(s.Rules, t.Rule) {
+		return false
+	}
+	if len(s.Devices) > 0 {
+		matched := false
+		for _, d := range t.Devices {
+			for _, p := range s.Devices {
+				if ok, _ := path.Match(p, d); ok {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(s.Sites) > 0 {
+		matched := false
+		for _, site := range t.Sites {
+			if contains(s.Sites, site) {
+				matched = true
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Window is a period during which incidents in its scope are suppressed. Recurring
+// windows start at Start, in Timezone, on each of Days (every day if empty) and last for
+// Duration. If From or To are set, they only start between From and To.
+// Windows without a Start are ad-hoc freezes that last from From to To.
+type Window struct {
+	Name   string
+	Reason string
+	Scope  `yaml:",inline"`
+	// Start is the time of day as 15:04
+	Start    string
+	Days     []string
+	Duration time.Duration
+	Timezone string
+	From     time.Time
+	To       time.Time
+}
+
+// Validate checks that the window is either recurring or a freeze
+func (w Window) Validate() error {
+	if w.Start == "" {
+		if w.From.IsZero() || w.To.IsZero() {
+			return fmt.Errorf("A freeze requires from and to")
+		}
+		if !w.To.After(w.From) {
+			return fmt.Errorf("A freeze must end after it starts")
+		}
+		return nil
+	}
+	if _, err := time.Parse("15:04", w.Start); err != nil {
+		return fmt.Errorf("Invalid start %s: %v", w.Start, err)
+	}
+	if w.Duration <= 0 {
+		return fmt.Errorf("A recurring window requires a duration")
+	}
+	for _, d := range w.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("Invalid day %s", d)
+		}
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("Invalid timezone %s: %v", w.Timezone, err)
+	}
+	return nil
+}
+
+// Active returns true if now is within the window
+func (w Window) Active(now time.Time) bool {
+	if w.Start == "" {
+		return !now.Before(w.From) && now.Before(w.To)
+	}
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return false
+	}
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return false
+	}
+	now = now.In(loc)
+	// the earliest occurrence that can still be running started this many days ago
+	days := int(w.Duration/(24*time.Hour)) + 1
+	for d := 0; d <= days; d++ {
+		day := now.AddDate(0, 0, -d)
+		begin := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, loc)
+		if !w.onDay(begin.Weekday()) {
+			continue
+		}
+		if (!w.From.IsZero() && begin.Before(w.From)) || (!w.To.IsZero() && begin.After(w.To)) {
+			continue
+		}
+		if !now.Before(begin) && now.Before(begin.Add(w.Duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes why incidents are suppressed by the window
+func (w Window) String() string {
+	if w.Reason == "" {
+		return fmt.Sprintf("In maintenance window %s", w.Name)
+	}
+	return fmt.Sprintf("In maintenance window %s: %s", w.Name, w.Reason)
+}
+
+// Calendar is an ICS file of maintenance windows. The scope applies to all of its events,
+// events can override it with X-AR-RULES, X-AR-DEVICES and X-AR-SITES.
+type Calendar struct {
+	Path  string
+	Scope `yaml:",inline"`
+}
+
+type calendar struct {
+	Calendar
+	modTime time.Time
+	windows []Window
+}
+
+// load (re)loads the windows of the calendar if the file changed since it was loaded
+func (c *calendar) load() error {
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return fmt.Errorf("Unable to read calendar: %v", err)
+	}
+	if info.ModTime().Equal(c.modTime) {
+		return nil
+	}
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return fmt.Errorf("Unable to read calendar: %v", err)
+	}
+	defer f.Close()
+	windows, err := ParseICS(f, c.Scope)
+	if err != nil {
+		return fmt.Errorf("Unable to parse calendar %s: %v", c.Path, err)
+	}
+	c.windows, c.modTime = windows, info.ModTime()
+	return nil
+}
+
+// Schedule answers whether incidents are in a maintenance window
+type Schedule struct {
+	windows   []Window
+	calendars []*calendar
+	sync.Mutex
+}
+
+func NewSchedule(c Config) (*Schedule, error) {
+	s := &Schedule{windows: c.Windows}
+	for _, w := range c.Windows {
+		if err := w.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid maintenance window %s: %v", w.Name, err)
+		}
+	}
+	for _, cal := range c.Calendars {
+		loaded := &calendar{Calendar: cal}
+		if err := loaded.load(); err != nil {
+			return nil, err
+		}
+		s.calendars = append(s.calendars, loaded)
+	}
+	return s, nil
+}
+
+// Check returns the window that the target is in at the given time, if any. Calendars
+// that changed since they were loaded are reloaded first.
+func (s *Schedule) Check(t Target, now time.Time) (Window, bool) {
+	if s == nil {
+		return Window{}, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	windows := append([]Window{}, s.windows...)
+	for _, c := range s.calendars {
+		if err := c.load(); err != nil {
+			glog.Errorf("Failed to reload calendar, using the windows loaded before: %v", err)
+		}
+		windows = append(windows, c.windows...)
+	}
+	for _, w := range windows {
+		if w.Scope.Matches(t) && w.Active(now) {
+			return w, true
+		}
+	}
+	return Window{}, false
+}
@@ -0,0 +1,154 @@
+package maintenance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+var testConfig = `
+windows:
+  - name: Weekly BB upgrades
+    reason: CHG-1234
+    rules: [ BB Link Errors ]
+    devices: [ "bb*.sjc1" ]
+    start: "22:00"
+    days: [ sat, sun ]
+    duration: 4h
+    timezone: America/Los_Angeles
+  - name: DC move
+    sites: [ ams2 ]
+    from: 2019-06-10T08:00:00Z
+    to: 2019-06-12T08:00:00Z
+`
+
+func at(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestWindows(t *testing.T) {
+	var c Config
+	if err := yaml.Unmarshal([]byte(testConfig), &c); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSchedule(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb := Target{Rule: "BB Link Errors", Devices: []string{"bb1.sjc1"}, Sites: []string{"sjc1"}}
+	tests := []struct {
+		target Target
+		now    string
+		window string
+	}{
+		// saturday 23:00 and sunday 01:30 local time, in the saturday window
+		{bb, "2019-06-16T06:00:00Z", "Weekly BB upgrades"},
+		{bb, "2019-06-16T08:30:00Z", "Weekly BB upgrades"},
+		// sunday 02:00 local, the saturday window is over
+		{bb, "2019-06-16T09:00:00Z", ""},
+		// friday 23:00 local
+		{bb, "2019-06-15T06:00:00Z", ""},
+		{Target{Rule: "Other", Devices: []string{"bb1.sjc1"}}, "2019-06-16T06:00:00Z", ""},
+		{Target{Rule: "BB Link Errors", Devices: []string{"dr1.sjc1"}}, "2019-06-16T06:00:00Z", ""},
+		{Target{Rule: "Other", Sites: []string{"ams2"}}, "2019-06-11T00:00:00Z", "DC move"},
+		{Target{Rule: "Other", Sites: []string{"ams2"}}, "2019-06-12T08:00:00Z", ""},
+		{Target{Rule: "Other", Sites: []string{"ams1"}}, "2019-06-11T00:00:00Z", ""},
+	}
+	for _, tt := range tests {
+		w, ok := s.Check(tt.target, at(tt.now))
+		assert.Equal(t, ok, tt.window != "", tt.now)
+		assert.Equal(t, w.Name, tt.window, tt.now)
+	}
+	w, _ := s.Check(bb, at("2019-06-16T06:00:00Z"))
+	assert.Equal(t, w.String(), "In maintenance window Weekly BB upgrades: CHG-1234")
+
+	_, err = NewSchedule(Config{Windows: []Window{{Name: "bad", Start: "25:00", Duration: time.Hour}}})
+	assert.Contains(t, err.Error(), "Invalid maintenance window bad: Invalid start 25:00")
+	_, err = NewSchedule(Config{Windows: []Window{{Name: "bad", From: at("2019-06-10T08:00:00Z")}}})
+	assert.Contains(t, err.Error(), "A freeze requires from and to")
+}
+
+var testICS = `BEGIN:VCALENDAR
+VERSION:2.0
+BEGIN:VEVENT
+SUMMARY:Optics swap
+DESCRIPTION:Swapping optics on
+  dr1
+DTSTART:20190610T220000Z
+DTEND:20190611T020000Z
+X-AR-DEVICES:dr1.*
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Nightly backups
+DTSTART;TZID=Europe/Amsterdam:20190601T010000
+DURATION:PT1H30M
+RRULE:FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20190630T235959Z
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:Monthly patching
+DTSTART:20190601T010000Z
+DURATION:PT1H
+RRULE:FREQ=MONTHLY
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestCalendar(t *testing.T) {
+	windows, err := ParseICS(strings.NewReader(testICS), Scope{Sites: []string{"ams2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the monthly event is not supported
+	assert.Equal(t, len(windows), 2)
+	assert.Equal(t, windows[0].Reason, "Swapping optics on dr1")
+	assert.Equal(t, windows[0].Devices, []string{"dr1.*"})
+	assert.Equal(t, windows[0].Sites, []string{"ams2"})
+	assert.True(t, windows[0].Active(at("2019-06-11T01:00:00Z")))
+	assert.False(t, windows[0].Active(at("2019-06-11T02:00:00Z")))
+	assert.Equal(t, windows[1].Days, []string{"mon", "wed"})
+	// wednesday 02:00 in Amsterdam
+	assert.True(t, windows[1].Active(at("2019-06-12T00:00:00Z")))
+	assert.False(t, windows[1].Active(at("2019-06-13T00:00:00Z")))
+	assert.False(t, windows[1].Active(at("2019-07-03T00:00:00Z")))
+
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "freezes.ics")
+	if err := ioutil.WriteFile(path, []byte(testICS), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSchedule(Config{Calendars: []Calendar{{Path: path}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr1 := Target{Rule: "BB Link Errors", Devices: []string{"dr1.sjc1"}}
+	w, ok := s.Check(dr1, at("2019-06-11T01:00:00Z"))
+	assert.True(t, ok)
+	assert.Equal(t, w.Name, "Optics swap")
+
+	// changes to the calendar are picked up
+	ics := strings.Replace(testICS, "dr1.*", "dr2.*", 1)
+	if err := ioutil.WriteFile(path, []byte(ics), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	_, ok = s.Check(dr1, at("2019-06-11T01:00:00Z"))
+	assert.False(t, ok)
+
+	_, err = NewSchedule(Config{Calendars: []Calendar{{Path: filepath.Join(dir, "missing.ics")}}})
+	assert.Contains(t, err.Error(), "Unable to read calendar")
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"net"
 	"strings"
@@ -34,29 +35,105 @@ var schema = `
 	runtime INT,
 	logs TEXT,
 	results TEXT);
+
+  CREATE TABLE IF NOT EXISTS artifacts (
+	id SERIAL PRIMARY KEY,
+	command_id INT NOT NULL,
+	name TEXT NOT NULL,
+	path TEXT NOT NULL,
+	size BIGINT);
+
+  CREATE TABLE IF NOT EXISTS suppressions (
+	id SERIAL PRIMARY KEY,
+	incident_name VARCHAR(128) NOT NULL,
+	incident_id INT NOT NULL,
+	incident_type VARCHAR(32),
+	entities VARCHAR(128)[] DEFAULT array[]::varchar[],
+	time BIGINT NOT NULL,
+	window_name TEXT,
+	reason TEXT);
+
+  CREATE TABLE IF NOT EXISTS paused_rules (
+	rule VARCHAR(128) PRIMARY KEY,
+	reason TEXT,
+	time BIGINT NOT NULL);
+
+  ALTER TABLE remediations ADD COLUMN IF NOT EXISTS verified BOOLEAN;
+  ALTER TABLE remediations ADD COLUMN IF NOT EXISTS approver VARCHAR(64) DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS passed BOOLEAN;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS message TEXT DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS severity VARCHAR(32) DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS suggested_next TEXT DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS data TEXT DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS failure VARCHAR(32) DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS attempt INT DEFAULT 1;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS bundle_version VARCHAR(64) DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS stdout_artifact TEXT DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS stderr_artifact TEXT DEFAULT '';
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS start_time_ms BIGINT DEFAULT 0;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS end_time_ms BIGINT DEFAULT 0;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS user_time_ms BIGINT DEFAULT 0;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS sys_time_ms BIGINT DEFAULT 0;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS max_rss BIGINT DEFAULT 0;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS args TEXT[] DEFAULT array[]::text[];
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS env TEXT[] DEFAULT array[]::text[];
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS cached BOOLEAN DEFAULT false;
+  ALTER TABLE commands ADD COLUMN IF NOT EXISTS stage VARCHAR(32) DEFAULT '';
   `
 
 var (
 	QueryInsertNewRemediation = `INSERT INTO
     remediations (
-      incident_name, incident_id, status, entities, start_time, end_time, task_id, attempts
+      incident_name, incident_id, status, entities, start_time, end_time, task_id, attempts, verified, approver
     ) VALUES (
-	  :incident_name, :incident_id, :status, :entities, :start_time, :end_time, :task_id, :attempts
+	  :incident_name, :incident_id, :status, :entities, :start_time, :end_time, :task_id, :attempts, :verified, :approver
 	) RETURNING id`
 	QueryRemByIncidentId = "SELECT * FROM remediations WHERE incident_id=$1"
 	QueryRemByNameEntity = "SELECT * FROM remediations WHERE incident_name=? AND entities @> ARRAY[?]::varchar[]"
 
+	// a remediation read before it was verified does not reset verified
 	QueryUpdateRemById = `UPDATE remediations SET
 	  incident_name=:incident_name, incident_id=:incident_id, status=:status,
-	  entities=:entities, start_time=:start_time, end_time=:end_time, task_id=:task_id, attempts=:attempts
+	  entities=:entities, start_time=:start_time, end_time=:end_time, task_id=:task_id, attempts=:attempts,
+	  verified=COALESCE(:verified, verified), approver=:approver
 	WHERE id=:id`
+	QueryUpdateVerified = "UPDATE remediations SET verified=$2 WHERE id=$1"
+
+	QueryEffectiveness = `SELECT
+	  COUNT(*) FILTER (WHERE verified) AS verified, COUNT(*) FILTER (WHERE NOT verified) AS ineffective
+	FROM remediations WHERE incident_name=$1`
 
 	QueryInsertNewCmd = `INSERT INTO
 	commands (
-		remediation_id, command, retcode, runtime, logs, results
+		remediation_id, command, retcode, runtime, logs, results,
+		passed, message, severity, suggested_next, data, failure, attempt, bundle_version,
+		stdout_artifact, stderr_artifact, start_time_ms, end_time_ms,
+		user_time_ms, sys_time_ms, max_rss, args, env, cached, stage
+	) VALUES (
+		:remediation_id, :command, :retcode, :runtime, :logs, :results,
+		:passed, :message, :severity, :suggested_next, :data, :failure, :attempt, :bundle_version,
+		:stdout_artifact, :stderr_artifact, :start_time_ms, :end_time_ms,
+		:user_time_ms, :sys_time_ms, :max_rss, :args, :env, :cached, :stage
+	) RETURNING id`
+
+	QueryInsertNewArtifact = `INSERT INTO
+	artifacts (
+		command_id, name, path, size
 	) VALUES (
-		:remediation_id, :command, :retcode, :runtime, :logs, :results
+		:command_id, :name, :path, :size
 	) RETURNING id`
+
+	QueryInsertNewSuppression = `INSERT INTO
+	suppressions (
+		incident_name, incident_id, incident_type, entities, time, window_name, reason
+	) VALUES (
+		:incident_name, :incident_id, :incident_type, :entities, :time, :window_name, :reason
+	) RETURNING id`
+
+	QueryPauseRule = `INSERT INTO paused_rules (rule, reason, time) VALUES (:rule, :reason, :time)
+	  ON CONFLICT (rule) DO UPDATE SET reason=EXCLUDED.reason, time=EXCLUDED.time`
+	QueryResumeRule  = "DELETE FROM paused_rules WHERE rule=$1"
+	QueryPausedRules = "SELECT * FROM paused_rules"
 )
 
 type Dbase interface {
@@ -64,6 +141,11 @@ type Dbase interface {
 	NewRecord(i interface{}) (int64, error)
 	GetRemediations(query string, args ...interface{}) ([]*Remediation, error)
 	Query(table string, params map[string]interface{}) ([]interface{}, error)
+	Effectiveness(rule string) (*Effectiveness, error)
+	SetVerified(id int64, verified bool) error
+	PauseRule(p *PausedRule) error
+	ResumeRule(rule string) error
+	PausedRules() ([]*PausedRule, error)
 	Close() error
 }
 
@@ -102,6 +184,10 @@ func (db *DB) NewRecord(i interface{}) (int64, error) {
 		stmt, err = db.PrepareNamed(QueryInsertNewRemediation)
 	case *Command:
 		stmt, err = db.PrepareNamed(QueryInsertNewCmd)
+	case *Artifact:
+		stmt, err = db.PrepareNamed(QueryInsertNewArtifact)
+	case *Suppression:
+		stmt, err = db.PrepareNamed(QueryInsertNewSuppression)
 	}
 	if err != nil {
 		return newId, err
@@ -153,10 +239,60 @@ func (db *DB) Query(table string, params map[string]interface{}) ([]interface{},
 		for _, c := range cmds {
 			items = append(items, c)
 		}
+	case "artifacts":
+		var artifacts []*Artifact
+		err = db.Select(&artifacts, query, args...)
+		for _, a := range artifacts {
+			items = append(items, a)
+		}
+	case "suppressions":
+		var suppressions []*Suppression
+		err = db.Select(&suppressions, query, args...)
+		for _, s := range suppressions {
+			items = append(items, s)
+		}
 	}
 	return items, err
 }
 
+// SetVerified marks remediation id as verified or ineffective. Updating only this column
+// keeps changes made to the remediation while it was verified.
+func (db *DB) SetVerified(id int64, verified bool) error {
+	_, err := db.Exec(QueryUpdateVerified, id, verified)
+	return err
+}
+
+// PauseRule records that a rule is paused, so that it stays paused across restarts
+func (db *DB) PauseRule(p *PausedRule) error {
+	_, err := db.NamedExec(QueryPauseRule, p)
+	return err
+}
+
+// ResumeRule removes the record of a paused rule
+func (db *DB) ResumeRule(rule string) error {
+	_, err := db.Exec(QueryResumeRule, rule)
+	return err
+}
+
+// PausedRules returns the rules that are paused until they are re-enabled
+func (db *DB) PausedRules() ([]*PausedRule, error) {
+	var paused []*PausedRule
+	err := db.Select(&paused, QueryPausedRules)
+	return paused, err
+}
+
+// Effectiveness returns how many of the verified remediations of rule were effective
+func (db *DB) Effectiveness(rule string) (*Effectiveness, error) {
+	e := &Effectiveness{Rule: rule}
+	if err := db.Get(e, QueryEffectiveness, rule); err != nil {
+		return nil, err
+	}
+	if total := e.Verified + e.Ineffective; total > 0 {
+		e.Rate = float64(e.Verified) / float64(total)
+	}
+	return e, nil
+}
+
 type MyTime struct {
 	time.Time
 }
@@ -178,6 +314,32 @@ func (t *MyTime) Scan(src interface{}) error {
 	return nil
 }
 
+// JSONMap is a map stored as JSON text in the DB
+type JSONMap map[string]interface{}
+
+func (m JSONMap) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return driver.Value(""), nil
+	}
+	data, err := json.Marshal(map[string]interface{}(m))
+	if err != nil {
+		return nil, err
+	}
+	return driver.Value(string(data)), nil
+}
+
+func (m *JSONMap) Scan(src interface{}) error {
+	ns := sql.NullString{}
+	if err := ns.Scan(src); err != nil {
+		return err
+	}
+	if !ns.Valid || ns.String == "" {
+		*m = nil
+		return nil
+	}
+	return json.Unmarshal([]byte(ns.String), m)
+}
+
 type MyNullTime struct {
 	pq.NullTime
 }
@@ -223,6 +385,15 @@ const (
 	Status_ONCLEAR_FAILED      Status = 5
 	Status_ONCLEAR_SUCCESS     Status = 6
 	Status_ERROR               Status = 7
+	Status_TIMED_OUT           Status = 8
+	Status_CANCELLED           Status = 9
+	Status_DRY_RUN             Status = 10
+	Status_ROLLBACK_SUCCESS    Status = 11
+	Status_ROLLBACK_FAILED     Status = 12
+	Status_WAITING_APPROVAL    Status = 13
+	Status_APPROVAL_REJECTED   Status = 14
+	Status_APPROVAL_EXPIRED    Status = 15
+	Status_RATE_LIMITED        Status = 16
 )
 
 var StatusMap = map[string]Status{
@@ -233,9 +404,21 @@ var StatusMap = map[string]Status{
 	"onclear_failed":      Status_ONCLEAR_FAILED,
 	"onclear_success":     Status_ONCLEAR_SUCCESS,
 	"error":               Status_ERROR,
+	"timed_out":           Status_TIMED_OUT,
+	"cancelled":           Status_CANCELLED,
+	"dry_run":             Status_DRY_RUN,
+	"rollback_success":    Status_ROLLBACK_SUCCESS,
+	"rollback_failed":     Status_ROLLBACK_FAILED,
+	"waiting_approval":    Status_WAITING_APPROVAL,
+	"approval_rejected":   Status_APPROVAL_REJECTED,
+	"approval_expired":    Status_APPROVAL_EXPIRED,
+	"rate_limited":        Status_RATE_LIMITED,
 }
 
-var StatusFailed = []Status{Status_AUDIT_FAILED, Status_REMEDIATION_FAILED, Status_ERROR}
+var StatusFailed = []Status{
+	Status_AUDIT_FAILED, Status_REMEDIATION_FAILED, Status_ERROR, Status_TIMED_OUT, Status_CANCELLED,
+	Status_ROLLBACK_SUCCESS, Status_ROLLBACK_FAILED, Status_APPROVAL_EXPIRED, Status_RATE_LIMITED,
+}
 
 func (s Status) IsFailed() bool {
 	for _, status := range StatusFailed {
@@ -256,11 +439,24 @@ type Remediation struct {
 	EndTime      MyNullTime `db:"end_time"`
 	TaskId       string     `db:"task_id"`
 	Attempts     int
+	// Verified is set once a successful remediation has been verified, to false if it
+	// turned out to be ineffective
+	Verified *bool
+	// Approver is the user that approved or rejected the remediation
+	Approver string
+}
+
+// Effectiveness is the share of the verified remediations of a rule that were effective
+type Effectiveness struct {
+	Rule        string
+	Verified    int
+	Ineffective int
+	Rate        float64
 }
 
 func (r *Remediation) End(status Status, db Dbase) error {
 	r.Status = status
-	r.EndTime = MyNullTime{pq.NullTime{time.Now(), true}}
+	r.EndTime = MyNullTime{pq.NullTime{Time: time.Now(), Valid: true}}
 	err := db.UpdateRecord(r)
 	if err != nil {
 		glog.Errorf("Failed to update record: %v", err)
@@ -269,45 +465,135 @@ func (r *Remediation) End(status Status, db Dbase) error {
 }
 
 func NewRemediation(incident executor.Incident) *Remediation {
-	var entities []string
-	if incident.IsAggregate {
-		if components, ok := incident.Data["components"]; ok {
-			for _, alertData := range components.([]map[string]interface{}) {
-				if d, ok := alertData["device"]; ok {
-					entities = append(entities, fmt.Sprintf("%v:%v", d, alertData["entity"]))
-				} else {
-					entities = append(entities, alertData["entity"].(string))
-				}
-			}
-		}
-	} else {
-		if d, ok := incident.Data["device"]; ok {
-			entities = append(entities, fmt.Sprintf("%v:%v", d, incident.Data["entity"]))
-		} else {
-			entities = append(entities, incident.Data["entity"].(string))
-		}
-	}
 	return &Remediation{
 		Status:       Status_ACTIVE,
 		IncidentName: incident.Name,
 		IncidentId:   incident.Id,
-		Entities:     pq.StringArray(entities),
+		Entities:     pq.StringArray(incident.Entities()),
 		StartTime:    MyTime{time.Now()},
 	}
 }
 
 type Command struct {
-	Id            int64
-	RemediationId int64 `db:"remediation_id"`
-	Command       string
-	Retcode       int
-	Runtime       int64
-	Logs          string
-	Results       string
+	Id             int64
+	RemediationId  int64 `db:"remediation_id"`
+	Command        string
+	Retcode        int
+	Runtime        int64
+	Logs           string
+	Results        string
+	Passed         *bool
+	Message        string
+	Severity       string
+	SuggestedNext  string `db:"suggested_next"`
+	Data           JSONMap
+	Failure        string
+	Attempt        int
+	BundleVersion  string `db:"bundle_version"`
+	StdoutArtifact string `db:"stdout_artifact"`
+	StderrArtifact string `db:"stderr_artifact"`
+	// StartTimeMs and EndTimeMs are unix timestamps in milliseconds
+	StartTimeMs int64 `db:"start_time_ms"`
+	EndTimeMs   int64 `db:"end_time_ms"`
+	UserTimeMs  int64 `db:"user_time_ms"`
+	SysTimeMs   int64 `db:"sys_time_ms"`
+	// MaxRss is the max resident set size of the command in bytes
+	MaxRss int64 `db:"max_rss"`
+	// Args and Env are the rendered args and env the command ran with
+	Args pq.StringArray
+	Env  pq.StringArray
+	// Cached is set if the result of an earlier run of the command was reused
+	Cached bool
+	// Stage is the stage of the remediation the command ran in: audit, remediation,
+	// verify, rollback or onclear
+	Stage string
+	// Artifacts are the files the command produced, they are stored in their own table
+	Artifacts []*Artifact `db:"-" json:",omitempty"`
+}
+
+// Artifact is a file produced by a command, kept in the artifact store
+type Artifact struct {
+	Id        int64
+	CommandId int64 `db:"command_id"`
+	Name      string
+	Path      string
+	Size      int64
+}
+
+// Suppression records an incident that was not acted on because it was in a maintenance
+// window
+type Suppression struct {
+	Id           int64
+	IncidentName string `db:"incident_name"`
+	IncidentId   int64  `db:"incident_id"`
+	IncidentType string `db:"incident_type"`
+	Entities     pq.StringArray
+	Time         MyTime
+	Window       string `db:"window_name"`
+	Reason       string
+}
+
+func NewSuppression(incident executor.Incident, window, reason string) *Suppression {
+	return &Suppression{
+		IncidentName: incident.Name,
+		IncidentId:   incident.Id,
+		IncidentType: incident.Type,
+		Entities:     pq.StringArray(incident.Entities()),
+		Time:         MyTime{time.Now()},
+		Window:       window,
+		Reason:       reason,
+	}
+}
+
+// PausedRule is a rule that was paused after an incident storm and is not acted on until
+// it is re-enabled
+type PausedRule struct {
+	Rule   string
+	Reason string
+	Time   MyTime
+}
+
+func NewPausedRule(rule, reason string) *PausedRule {
+	return &PausedRule{Rule: rule, Reason: reason, Time: MyTime{time.Now()}}
+}
+
+// SetUsage copies the timestamps and resource usage of the command run
+func (c *Command) SetUsage(r *executor.CmdResult) {
+	if !r.StartTime.IsZero() {
+		c.StartTimeMs = r.StartTime.UnixNano() / int64(time.Millisecond)
+	}
+	if !r.EndTime.IsZero() {
+		c.EndTimeMs = r.EndTime.UnixNano() / int64(time.Millisecond)
+	}
+	c.UserTimeMs = int64(r.UserTime / time.Millisecond)
+	c.SysTimeMs = int64(r.SysTime / time.Millisecond)
+	c.MaxRss = r.MaxRSS
+}
+
+// SetResult copies the structured result reported by the command
+func (c *Command) SetResult(r *executor.Result) {
+	if r == nil {
+		return
+	}
+	c.Passed = r.Passed
+	c.Message = r.Message
+	c.Severity = r.Severity
+	c.SuggestedNext = r.SuggestedNext
+	c.Data = JSONMap(r.Data)
 }
 
 func (c Command) String() string {
-	return fmt.Sprintf("%s Results: \n%s\n\n", c.Command, c.Results)
+	if c.Failure != "" && c.Message == "" {
+		return fmt.Sprintf("%s Failed (%s), Results: \n%s\n\n", c.Command, c.Failure, c.Results)
+	}
+	if c.Message == "" {
+		return fmt.Sprintf("%s Results: \n%s\n\n", c.Command, c.Results)
+	}
+	str := fmt.Sprintf("%s: %s\n", c.Command, c.Message)
+	if c.SuggestedNext != "" {
+		str += fmt.Sprintf("Suggested next step: %s\n", c.SuggestedNext)
+	}
+	return str + "\n"
 }
 
 type Commands []*Command
@@ -319,3 +605,14 @@ func (c Commands) String() string {
 	}
 	return str
 }
+
+// Messages returns the messages reported by the commands, one per line
+func (c Commands) Messages() string {
+	var msgs []string
+	for _, cmd := range c {
+		if cmd.Message != "" {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", cmd.Command, cmd.Message))
+		}
+	}
+	return strings.Join(msgs, "\n")
+}
@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/mayuresh82/auto_remediation/executor"
+	"github.com/mayuresh82/auto_remediation/maintenance"
+	"github.com/mayuresh82/auto_remediation/secrets"
 	"gopkg.in/yaml.v2"
 )
 
@@ -29,7 +31,14 @@ type Config struct {
 	ScriptsURL         string        `yaml:"scripts_url"`
 	ScriptsPath        string        `yaml:"scripts_path"`
 	FetchInterval      time.Duration `yaml:"scripts_fetch_interval"`
+	BundlesDir         string        `yaml:"scripts_bundles_dir"`
+	KeepBundles        int           `yaml:"scripts_keep_bundles"`
+	ValidateCmd        []string      `yaml:"scripts_validate_cmd"`
 	CommonOpts         string        `yaml:"common_opts_file"`
+	KillGracePeriod    time.Duration `yaml:"kill_grace_period"`
+	MaxOutputSize      int           `yaml:"max_output_size"`
+	ArtifactsDir       string        `yaml:"artifacts_dir"`
+	DryRun             bool          `yaml:"dry_run"`
 	IncidentTimeout    time.Duration `yaml:"incident_timeout"`
 	DbAddr             string        `yaml:"db_addr"`
 	DbName             string        `yaml:"db_name"`
@@ -43,6 +52,21 @@ type Config struct {
 	JiraUser           string        `yaml:"jira_username"`
 	JiraPass           string        `yaml:"jira_password"`
 	JiraProject        string        `yaml:"jira_project"`
+	// JiraAttachArtifacts attaches the files produced by commands to the jira task
+	JiraAttachArtifacts bool `yaml:"jira_attach_artifacts"`
+	// SecretProviders are the providers that commands can reference secrets from by name
+	SecretProviders map[string]secrets.Config `yaml:"secret_providers"`
+	// RemoteWorkers runs commands on the workers of their region instead of locally
+	RemoteWorkers *executor.RemoteOptions `yaml:"remote_workers"`
+	// Approvers maps the users that can approve remediations to their passwords, the
+	// admin user can approve too
+	Approvers map[string]string
+	// Maintenance suppresses incidents during maintenance windows and change freezes
+	Maintenance maintenance.Config
+	// RateLimit limits the remediations of all rules together
+	RateLimit *RateLimit `yaml:"rate_limit"`
+	// Storm applies to the rules that dont set their own storm detection
+	Storm *StormDetection
 }
 
 type Rule struct {
@@ -56,6 +80,100 @@ type Rule struct {
 	Audits             []executor.Command
 	Remediations       []executor.Command
 	OnClear            []executor.Command `yaml:"on_clear"`
+	// BundleVersion pins the version of the scripts bundle the commands of the rule run from
+	BundleVersion string `yaml:"bundle_version"`
+	// DryRun runs the audits of the rule as usual but only dry runs its remediations and on_clear
+	DryRun bool `yaml:"dry_run"`
+	// Isolation applies to the commands of the rule that dont set their own
+	Isolation *executor.Isolation
+	// Region is the region of the remote workers that run the commands of the rule, it is
+	// rendered against the incident like args. Incidents without the fields it refers to
+	// run in the default region.
+	Region string
+	// Verify checks that successful remediations of the rule were effective
+	Verify *Verify
+	// Rollback runs if the remediations fail, after the undo commands of the remediation
+	// steps that succeeded
+	Rollback []executor.Command
+	// RequireApproval pauses the remediation after the audits until it is approved, steps
+	// can require approval for themselves instead
+	RequireApproval bool `yaml:"require_approval"`
+	// ApprovalTimeout aborts remediations that are not approved in time
+	ApprovalTimeout time.Duration `yaml:"approval_timeout"`
+	// RateLimit limits the remediations of the rule
+	RateLimit *RateLimit `yaml:"rate_limit"`
+	// Storm pauses the rule when its incidents spike
+	Storm *StormDetection
+}
+
+// RateLimit allows at most Max remediations to start within Window
+type RateLimit struct {
+	Max    int
+	Window time.Duration
+}
+
+// StormDetection pauses a rule once more than Max of its incidents arrive within Window,
+// until the rule is re-enabled through the admin API
+type StormDetection struct {
+	Max    int
+	Window time.Duration
+}
+
+// Verify checks a successful remediation: the alert must clear within WaitForClear, if
+// set, after which Commands must pass.
+type Verify struct {
+	WaitForClear time.Duration `yaml:"wait_for_clear"`
+	Commands     []executor.Command
+}
+
+// checkLimit checks that a rate limit or storm detection allows Max events per Window
+func checkLimit(name string, max int, window time.Duration) error {
+	if max <= 0 || window <= 0 {
+		return fmt.Errorf("%s requires a max and a window", name)
+	}
+	return nil
+}
+
+// Validate checks that the steps of each stage of the rule form a valid DAG, that only
+// audits are cacheable, that only remediations require approval and that its limits are
+// set.
+func (r Rule) Validate() error {
+	if r.RateLimit != nil {
+		if err := checkLimit("rate_limit", r.RateLimit.Max, r.RateLimit.Window); err != nil {
+			return err
+		}
+	}
+	if r.Storm != nil {
+		if err := checkLimit("storm", r.Storm.Max, r.Storm.Window); err != nil {
+			return err
+		}
+	}
+	stages := map[string][]executor.Command{
+		"audits":       r.Audits,
+		"remediations": r.Remediations,
+		"on_clear":     r.OnClear,
+	}
+	if r.Verify != nil {
+		stages["verify"] = r.Verify.Commands
+	}
+	stages["rollback"] = r.Rollback
+	for _, cmd := range r.Remediations {
+		stages["undo of "+cmd.Name] = cmd.Undo
+	}
+	for stage, cmds := range stages {
+		if err := executor.ValidateSteps(cmds); err != nil {
+			return fmt.Errorf("%s: %v", stage, err)
+		}
+		for _, cmd := range cmds {
+			if cmd.Cacheable && stage != "audits" {
+				return fmt.Errorf("%s: Step %s is cacheable, only audits can be cached", stage, cmd.Name)
+			}
+			if cmd.RequireApproval && stage != "remediations" {
+				return fmt.Errorf("%s: Step %s requires approval, only remediations can", stage, cmd.Name)
+			}
+		}
+	}
+	return nil
 }
 
 type ConfigHandler struct {
@@ -74,6 +192,21 @@ func NewConfig(file string) (*ConfigHandler, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unable to decode yaml: %v", err)
 	}
+	if l := c.Config.RateLimit; l != nil {
+		if err := checkLimit("rate_limit", l.Max, l.Window); err != nil {
+			return nil, err
+		}
+	}
+	if l := c.Config.Storm; l != nil {
+		if err := checkLimit("storm", l.Max, l.Window); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid rule %s: %v", rule.AlertName, err)
+		}
+	}
 	return c, nil
 }
 
@@ -89,6 +222,18 @@ func (c *ConfigHandler) RuleByName(name string) (Rule, bool) {
 	return Rule{}, false
 }
 
+// IsApprover returns true if user can approve remediations with pass
+func (c *ConfigHandler) IsApprover(user, pass string) bool {
+	if user == "" {
+		return false
+	}
+	if user == c.Config.AdminUser && pass == c.Config.AdminPass {
+		return true
+	}
+	p, ok := c.Config.Approvers[user]
+	return ok && p == pass
+}
+
 func (c *ConfigHandler) AdminCreds() (string, string) {
 	return c.Config.AdminUser, c.Config.AdminPass
 }
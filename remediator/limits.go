@@ -0,0 +1,147 @@
+package remediator
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mayuresh82/auto_remediation/models"
+)
+
+// globalLimit is the key of the remediations of all rules
+const globalLimit = ""
+
+type event struct {
+	time time.Time
+	id   int64
+	desc string
+}
+
+// window keeps the events of the last period
+type window []event
+
+// prune drops the events before t, returning how many are left
+func (w *window) prune(t time.Time) int {
+	i := 0
+	for i < len(*w) && (*w)[i].time.Before(t) {
+		i++
+	}
+	*w = (*w)[i:]
+	return len(*w)
+}
+
+// limiter enforces rate limits on remediations and pauses rules during incident storms.
+// The zero value has no limits and no paused rules. Its state is kept in memory, the
+// remediator persists the paused rules and restores them at startup.
+type limiter struct {
+	remediations map[string]*window
+	incidents    map[string]*window
+	// paused maps the paused rules to the reason they were paused
+	paused map[string]string
+	sync.Mutex
+}
+
+func (l *limiter) get(m *map[string]*window, key string) *window {
+	if *m == nil {
+		*m = make(map[string]*window)
+	}
+	if _, ok := (*m)[key]; !ok {
+		(*m)[key] = &window{}
+	}
+	return (*m)[key]
+}
+
+// allow reserves a remediation of rule if neither the global limit nor the limit of the
+// rule is reached, else it returns an error describing the limit that was reached.
+func (l *limiter) allow(rule string, global, limit *RateLimit, now time.Time) error {
+	l.Lock()
+	defer l.Unlock()
+	limits := map[string]*RateLimit{globalLimit: global, rule: limit}
+	for key, limit := range limits {
+		if limit == nil {
+			continue
+		}
+		if l.get(&l.remediations, key).prune(now.Add(-limit.Window)) >= limit.Max {
+			scope := "rule " + rule
+			if key == globalLimit {
+				scope = "all rules"
+			}
+			return fmt.Errorf("Rate limit of %d remediations per %v reached for %s", limit.Max, limit.Window, scope)
+		}
+	}
+	for key, limit := range limits {
+		if limit != nil {
+			w := l.get(&l.remediations, key)
+			*w = append(*w, event{time: now})
+		}
+	}
+	return nil
+}
+
+// incident records incident id of rule, described by desc. An incident is only counted
+// once within the window. If this makes it a storm the rule is paused and the incidents
+// of the storm are returned.
+func (l *limiter) incident(rule string, id int64, desc string, storm *StormDetection, now time.Time) []string {
+	if storm == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.paused[rule]; ok {
+		return nil
+	}
+	w := l.get(&l.incidents, rule)
+	w.prune(now.Add(-storm.Window))
+	for _, e := range *w {
+		if e.id == id {
+			return nil
+		}
+	}
+	*w = append(*w, event{time: now, id: id, desc: desc})
+	if len(*w) <= storm.Max {
+		return nil
+	}
+	l.pause(rule, fmt.Sprintf("Rule %s is paused after %d incidents within %v", rule, len(*w), storm.Window))
+	var incidents []string
+	for _, e := range *w {
+		incidents = append(incidents, e.desc)
+	}
+	*w = nil
+	return incidents
+}
+
+// pause pauses rule for reason. The caller holds the lock.
+func (l *limiter) pause(rule, reason string) {
+	if l.paused == nil {
+		l.paused = make(map[string]string)
+	}
+	l.paused[rule] = reason
+}
+
+// restore pauses the rules that were paused before a restart
+func (l *limiter) restore(paused []*models.PausedRule) {
+	l.Lock()
+	defer l.Unlock()
+	for _, p := range paused {
+		l.pause(p.Rule, p.Reason)
+	}
+}
+
+// pausedReason returns why rule is paused, if it is
+func (l *limiter) pausedReason(rule string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	reason, ok := l.paused[rule]
+	return reason, ok
+}
+
+// resume re-enables a paused rule, returning false if it was not paused
+func (l *limiter) resume(rule string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.paused[rule]; !ok {
+		return false
+	}
+	delete(l.paused, rule)
+	return true
+}
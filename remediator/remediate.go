@@ -4,20 +4,25 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/lib/pq"
 	am "github.com/mayuresh82/auto_remediation/alert_manager"
 	"github.com/mayuresh82/auto_remediation/escalate"
 	"github.com/mayuresh82/auto_remediation/executor"
+	"github.com/mayuresh82/auto_remediation/maintenance"
 	"github.com/mayuresh82/auto_remediation/models"
 	"github.com/mayuresh82/auto_remediation/notify"
+	"github.com/mayuresh82/auto_remediation/secrets"
 )
 
 type Remediator struct {
 	Config          *ConfigHandler
 	Db              models.Dbase
+	Artifacts       *executor.ArtifactStore
 	queue           executor.IncidentQueue
 	executor        executor.Executioner
 	am              *am.AlertManager
@@ -25,6 +30,11 @@ type Remediator struct {
 	esc             escalate.TaskEscalator
 	recv            chan executor.Incident
 	exe             map[int64]chan struct{}
+	logs            map[int64]*executor.LogBuffer
+	approvals       map[int64]chan approval
+	verifying       map[int64]bool
+	maintenance     *maintenance.Schedule
+	limits          limiter
 	enabled         bool
 	activeIncidents map[int64]bool
 	sync.Mutex
@@ -43,18 +53,45 @@ func NewRemediator(configFile string) (*Remediator, error) {
 	recv := make(chan executor.Incident)
 	q.Register(recv)
 	db := models.NewDB(config.DbAddr, config.DbUsername, config.DbPassword, config.DbName, config.DbTimeout)
+	var secretStore executor.SecretResolver
+	if len(config.SecretProviders) > 0 {
+		if secretStore, err = secrets.NewStore(config.SecretProviders); err != nil {
+			return nil, err
+		}
+	}
+	schedule, err := maintenance.NewSchedule(config.Maintenance)
+	if err != nil {
+		return nil, err
+	}
+	artifacts := executor.NewArtifactStore(config.ArtifactsDir)
 	amgr := am.NewAlertManager(config.AlertManagerAddr, config.AmUsername, config.AmPassword, config.AmOwner, config.AmTeam, config.AmToken)
+	var exe executor.Executioner
+	if config.RemoteWorkers != nil {
+		if exe, err = executor.NewRemoteExecutor(remoteOptions(config), artifacts); err != nil {
+			return nil, err
+		}
+	} else {
+		exe = executor.NewExecutor(executorOptions(config, secretStore))
+	}
 	r := &Remediator{
 		Config:          c,
 		Db:              db,
+		Artifacts:       artifacts,
 		queue:           q,
-		executor:        executor.NewExecutor(config.ScriptsPath, config.ScriptsURL, config.CommonOpts, config.FetchInterval),
+		executor:        exe,
 		am:              amgr,
 		recv:            recv,
 		exe:             make(map[int64]chan struct{}),
+		logs:            make(map[int64]*executor.LogBuffer),
+		maintenance:     schedule,
 		enabled:         true,
 		activeIncidents: make(map[int64]bool),
 	}
+	paused, err := db.PausedRules()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load paused rules: %v", err)
+	}
+	r.limits.restore(paused)
 	if config.SlackUrl != "" {
 		r.notif = &notify.SlackNotifier{Url: config.SlackUrl, Channel: config.SlackChannel, Mention: config.SlackMention}
 	}
@@ -65,23 +102,105 @@ func NewRemediator(configFile string) (*Remediator, error) {
 		}
 		r.esc = esc
 	}
+	executor.RegisterAction("task_comment", executor.ActionFunc(r.taskCommentAction))
 	return r, nil
 }
 
-func getCmds(incident executor.Incident, inCmds []executor.Command) []executor.Command {
+const (
+	// how long the output of a finished remediation can still be streamed
+	logRetention = 15 * time.Minute
+	// how long remediations wait for approval unless their rule sets a timeout
+	defaultApprovalTimeout = time.Hour
+)
+
+var failureStatus = map[executor.Failure]models.Status{
+	executor.FailureTimeout:   models.Status_TIMED_OUT,
+	executor.FailureCancelled: models.Status_CANCELLED,
+}
+
+func executorOptions(config Config, secretStore executor.SecretResolver) executor.Options {
+	return executor.Options{
+		ScriptsPath:   config.ScriptsPath,
+		ScriptsURL:    config.ScriptsURL,
+		CommonOpts:    config.CommonOpts,
+		FetchInterval: config.FetchInterval,
+		BundlesDir:    config.BundlesDir,
+		KeepBundles:   config.KeepBundles,
+		ValidateCmd:   config.ValidateCmd,
+		KillGrace:     config.KillGracePeriod,
+		MaxOutputSize: config.MaxOutputSize,
+		ArtifactsDir:  config.ArtifactsDir,
+		Secrets:       secretStore,
+	}
+}
+
+// remoteOptions returns the remote worker options, which use the amqp server of the
+// incident queue unless they set their own
+func remoteOptions(config Config) executor.RemoteOptions {
+	opts := *config.RemoteWorkers
+	if opts.Addr == "" {
+		opts.Addr, opts.User, opts.Pass = config.AmqpAddr, config.AmqpUser, config.AmqpPass
+	}
+	return opts
+}
+
+// NewWorker returns a worker that runs the commands of region published by remediators
+// that run commands on remote workers
+func NewWorker(configFile, region string, concurrency int) (*executor.Worker, error) {
+	c, err := NewConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	config := c.Config
+	if config.RemoteWorkers == nil {
+		return nil, fmt.Errorf("remote_workers is not configured")
+	}
+	var secretStore executor.SecretResolver
+	if len(config.SecretProviders) > 0 {
+		if secretStore, err = secrets.NewStore(config.SecretProviders); err != nil {
+			return nil, err
+		}
+	}
+	return executor.NewWorker(region, concurrency, remoteOptions(config), executorOptions(config, secretStore))
+}
+
+func getCmds(incident executor.Incident, rule Rule, inCmds []executor.Command) []executor.Command {
 	var cmds []executor.Command
 	for _, cmd := range inCmds {
-		cmds = append(cmds, executor.Command{
-			Name:    cmd.Name,
-			Command: cmd.Command,
-			Args:    cmd.Args,
-			Timeout: cmd.Timeout,
-			Input:   &incident,
-		})
+		cmd.Input = &incident
+		if cmd.BundleVersion == "" {
+			cmd.BundleVersion = rule.BundleVersion
+		}
+		if cmd.Isolation == nil {
+			cmd.Isolation = rule.Isolation
+		}
+		if cmd.Region == "" {
+			cmd.Region = rule.Region
+		}
+		cmds = append(cmds, cmd)
 	}
 	return cmds
 }
 
+// dryRun returns true if the remediations and on_clear steps of rule should only be dry run
+func (r *Remediator) dryRun(rule Rule) bool {
+	return r.Config.Config.DryRun || rule.DryRun
+}
+
+// setDryRun marks cmds to run in dry run mode and returns a description of what would run
+func setDryRun(cmds []executor.Command) string {
+	var lines []string
+	for i := range cmds {
+		cmds[i].DryRun = true
+		desc := cmds[i].Describe()
+		if rendered, err := cmds[i].Render(); err == nil {
+			desc = rendered.Describe()
+		}
+		lines = append(lines, desc)
+	}
+	return strings.Join(lines, "\n")
+}
+
 func (r *Remediator) Disable() error {
 	r.Lock()
 	defer r.Unlock()
@@ -96,6 +215,33 @@ func (r *Remediator) Enable() error {
 	return nil
 }
 
+// RollbackScripts activates the previous scripts bundle and pauses scripts updates
+func (r *Remediator) RollbackScripts() error {
+	bm, ok := r.executor.(executor.BundleManager)
+	if !ok {
+		return fmt.Errorf("Executor does not manage scripts bundles")
+	}
+	return bm.Rollback()
+}
+
+// ResumeScripts resumes scripts updates after a rollback
+func (r *Remediator) ResumeScripts() error {
+	bm, ok := r.executor.(executor.BundleManager)
+	if !ok {
+		return fmt.Errorf("Executor does not manage scripts bundles")
+	}
+	return bm.Resume()
+}
+
+// ScriptsVersion returns the version of the active scripts bundle, if bundles are managed
+func (r *Remediator) ScriptsVersion() string {
+	bm, ok := r.executor.(executor.BundleManager)
+	if !ok {
+		return ""
+	}
+	return bm.BundleVersion()
+}
+
 func (r *Remediator) getActiveIncident(id int64) bool {
 	r.Lock()
 	defer r.Unlock()
@@ -114,6 +260,49 @@ func (r *Remediator) delActiveIncident(id int64) {
 	delete(r.activeIncidents, id)
 }
 
+// LogBuffer returns the live output buffer of remediation id, creating a new one if none
+// exists or the previous run of the remediation has finished.
+func (r *Remediator) LogBuffer(id int64) *executor.LogBuffer {
+	r.Lock()
+	defer r.Unlock()
+	if r.logs == nil {
+		r.logs = make(map[int64]*executor.LogBuffer)
+	}
+	buf, ok := r.logs[id]
+	if !ok || buf.Closed() {
+		buf = executor.NewLogBuffer(0)
+		r.logs[id] = buf
+	}
+	return buf
+}
+
+// Logs returns the output buffer of remediation id if it is running or finished recently
+func (r *Remediator) Logs(id int64) (*executor.LogBuffer, bool) {
+	r.Lock()
+	defer r.Unlock()
+	buf, ok := r.logs[id]
+	return buf, ok
+}
+
+// closeLogs marks the end of the output of remediation id. The buffer is kept around
+// for logRetention so that the logs of a finished run can still be fetched.
+func (r *Remediator) closeLogs(id int64) {
+	r.Lock()
+	buf, ok := r.logs[id]
+	r.Unlock()
+	if !ok {
+		return
+	}
+	buf.Close()
+	time.AfterFunc(logRetention, func() {
+		r.Lock()
+		defer r.Unlock()
+		if r.logs[id] == buf {
+			delete(r.logs, id)
+		}
+	})
+}
+
 func (r *Remediator) Start(ctx context.Context) {
 	glog.Infof("Waiting for incidents")
 	for {
@@ -148,6 +337,14 @@ func (r *Remediator) notify(rem *models.Remediation, msg string) {
 	}
 }
 
+// notifyResults sends msg along with the messages reported by the commands
+func (r *Remediator) notifyResults(rem *models.Remediation, msg string, results models.Commands) {
+	if msgs := results.Messages(); msgs != "" {
+		msg += "\n" + msgs
+	}
+	r.notify(rem, msg)
+}
+
 func (r *Remediator) newTask(inc *executor.Incident, rule Rule) *escalate.Task {
 	t := &escalate.Task{}
 	t.Title = fmt.Sprintf("Incident: %d:%s", inc.Id, inc.Name)
@@ -168,10 +365,33 @@ func (r *Remediator) addTaskComment(task *escalate.Task, comment string) {
 	}
 }
 
+// taskCommentAction is a go action that adds --comment to the task of the incident
+func (r *Remediator) taskCommentAction(ctx context.Context, cmd *executor.Command) (*executor.Result, error) {
+	if r.esc == nil {
+		return nil, fmt.Errorf("No task escalator configured")
+	}
+	taskID, _ := cmd.Input.Data["task_id"].(string)
+	if taskID == "" {
+		return nil, fmt.Errorf("Incident %d has no task", cmd.Input.Id)
+	}
+	comment := executor.ParseArgs(cmd.Args)["comment"]
+	task := &escalate.Task{ID: taskID, Params: map[string]string{"comment": comment}}
+	passed := true
+	msg := fmt.Sprintf("Added comment to task %s", taskID)
+	if err := r.esc.UpdateTask(task); err != nil {
+		passed = false
+		msg = fmt.Sprintf("Failed to comment on task %s: %v", taskID, err)
+	}
+	return &executor.Result{Passed: &passed, Message: msg}, nil
+}
+
 func (r *Remediator) updateTask(task *escalate.Task, inc executor.Incident, exeResults models.Commands, new bool) {
 	if r.esc == nil || task.ID == "" {
 		return
 	}
+	if r.Config.Config.JiraAttachArtifacts {
+		defer r.attachArtifacts(task, exeResults)
+	}
 	content := ""
 	if inc.Type == "CLEARED" {
 		content += "This incident has now CLEARED"
@@ -187,7 +407,62 @@ func (r *Remediator) updateTask(task *escalate.Task, inc executor.Incident, exeR
 	}
 }
 
+// attachArtifacts attaches the files produced by cmds to task
+func (r *Remediator) attachArtifacts(task *escalate.Task, cmds models.Commands) {
+	for _, cmd := range cmds {
+		for _, a := range cmd.Artifacts {
+			f, err := r.Artifacts.Open(a.Path)
+			if err != nil {
+				glog.Errorf("Failed to open artifact %s: %v", a.Path, err)
+				continue
+			}
+			name := fmt.Sprintf("%s-%s", cmd.Command, strings.Replace(a.Name, "/", "_", -1))
+			if err := r.esc.AttachFile(task, name, f); err != nil {
+				glog.Errorf("Failed to attach %s to task %s: %v", name, task.ID, err)
+			}
+			f.Close()
+		}
+	}
+}
+
+// execute runs cmds and ends the remediation with the status of the first failed step, if any
 func (r *Remediator) execute(rem *models.Remediation, itype string, cmds []executor.Command) (models.Commands, bool) {
+	ret, _, failed := r.runCmds(rem, itype, cmds)
+	return ret, r.endFailed(rem, itype, failed)
+}
+
+// endFailed ends the remediation with the status of the failed step, returning true if no
+// step failed
+func (r *Remediator) endFailed(rem *models.Remediation, itype string, failed *executor.CmdResult) bool {
+	if failed == nil {
+		return true
+	}
+	switch failed.Failure {
+	case executor.FailureRejected:
+		glog.V(2).Infof("Cmd %s was not approved: %v", failed.Command.Name, failed.Error)
+		// the status is set by the approval of the step
+		if rem.Status == models.Status_ACTIVE || rem.Status == models.Status_WAITING_APPROVAL {
+			rem.Status = models.Status_ERROR
+		}
+		rem.End(rem.Status, r.Db)
+	case executor.FailureTimeout, executor.FailureCancelled:
+		glog.V(2).Infof("Cmd %s was terminated: %v", failed.Command.Name, failed.Error)
+		rem.End(failureStatus[failed.Failure], r.Db)
+	case executor.FailureStartFailed, executor.FailureNotFound, executor.FailureBadOutput, executor.FailureKilledBySignal, executor.FailureTemplate, executor.FailureSecret, executor.FailureWorker:
+		glog.V(2).Infof("Failed to run cmd %s (%s): %v", failed.Command.Name, failed.Failure, failed.Error)
+		rem.End(models.Status_ERROR, r.Db)
+	default:
+		glog.V(2).Infof("Cmd %s failed with retcode %d: %s", failed.Command.Name, failed.RetCode, failed.Message())
+		glog.V(2).Infof("%s failed for incident %s", itype, rem.IncidentName)
+		statusStr := fmt.Sprintf("%s_failed", itype)
+		rem.End(models.StatusMap[statusStr], r.Db)
+	}
+	return false
+}
+
+// runCmds runs cmds and stores their results. It returns the steps that succeeded, in
+// dependency order, and the first step that failed in that order, if any.
+func (r *Remediator) runCmds(rem *models.Remediation, itype string, cmds []executor.Command) (models.Commands, []*executor.Command, *executor.CmdResult) {
 	glog.V(4).Infof("Running %s for remediation %d, incident %d", itype, rem.Id, rem.IncidentId)
 	e := make(chan struct{})
 	defer func() {
@@ -199,39 +474,69 @@ func (r *Remediator) execute(rem *models.Remediation, itype string, cmds []execu
 	r.Lock()
 	r.exe[rem.Id] = e
 	r.Unlock()
+	logs := r.LogBuffer(rem.Id)
+	for i := range cmds {
+		cmds[i].Logs = logs
+	}
 	results := r.executor.Execute(context.Background(), cmds, len(cmds))
-	var ret models.Commands
-	for cmd, result := range results {
+	var (
+		ret       models.Commands
+		succeeded []*executor.Command
+		failed    *executor.CmdResult
+	)
+	// a step fails if its last attempt failed
+	final := make(map[*executor.Command]*executor.CmdResult)
+	for _, result := range results {
+		final[result.Command] = result
+	}
+	for _, result := range results {
+		cmd := result.Command
 		glog.V(4).Infof("%s Logs:\n %v", cmd.Name, result.Stderr)
 		glog.V(4).Infof("%s output:\n %v", cmd.Name, result.Stdout)
 		c := &models.Command{
-			RemediationId: rem.Id,
-			Command:       cmd.Command,
-			Retcode:       result.RetCode,
-			Logs:          result.Stderr,
-			Results:       result.Stdout,
-			Runtime:       int64(result.Runtime.Seconds()),
+			RemediationId:  rem.Id,
+			Command:        cmd.Command,
+			Retcode:        result.RetCode,
+			Logs:           result.Stderr,
+			Results:        result.Stdout,
+			Runtime:        int64(result.Runtime.Seconds()),
+			Attempt:        result.Attempt,
+			BundleVersion:  result.BundleVersion,
+			StdoutArtifact: result.StdoutArtifact,
+			StderrArtifact: result.StderrArtifact,
+			Cached:         result.Cached,
+			Stage:          itype,
+		}
+		c.SetResult(result.Result)
+		c.SetUsage(result)
+		c.Args, c.Env = pq.StringArray(result.Args), pq.StringArray(result.Env)
+		c.Failure = string(result.Failure)
+		if result.Error != nil {
+			c.Results = fmt.Sprintf("Failed to run cmd %s: %v", cmd.Name, result.Error)
 		}
 		ret = append(ret, c)
-		if _, err := r.Db.NewRecord(c); err != nil {
+		id, err := r.Db.NewRecord(c)
+		if err != nil {
 			glog.Errorf("Failed to save cmd to db: %v", err)
 		}
-		if result.RetCode != 0 {
-			glog.V(2).Infof("Cmd %s failed with retcode %d and error %v", cmd.Name, result.RetCode, result.Error)
-			glog.V(2).Infof("%s failed for incident %s", itype, rem.IncidentName)
-			statusStr := fmt.Sprintf("%s_failed", itype)
-			rem.End(models.StatusMap[statusStr], r.Db)
-			return ret, false
+		c.Id = id
+		for _, a := range result.Artifacts {
+			artifact := &models.Artifact{CommandId: c.Id, Name: a.Name, Path: a.Path, Size: a.Size}
+			if artifact.Id, err = r.Db.NewRecord(artifact); err != nil {
+				glog.Errorf("Failed to save artifact to db: %v", err)
+			}
+			c.Artifacts = append(c.Artifacts, artifact)
+		}
+		if final[result.Command] != result {
+			continue
 		}
-		if result.Error != nil {
-			errStr := fmt.Sprintf("Failed to run cmd %s: %v", cmd.Name, result.Error)
-			glog.V(2).Infof(errStr)
-			rem.End(models.Status_ERROR, r.Db)
-			c.Results = errStr
-			return ret, false
+		if !result.Failed() {
+			succeeded = append(succeeded, result.Command)
+		} else if failed == nil {
+			failed = result
 		}
 	}
-	return ret, true
+	return ret, succeeded, failed
 }
 
 func (r *Remediator) processIncident(incident executor.Incident) *models.Remediation {
@@ -265,6 +570,9 @@ func (r *Remediator) processIncident(incident executor.Incident) *models.Remedia
 		glog.V(2).Infof("Incident %d already in the queue, skipping", incident.Id)
 		return nil
 	}
+	if r.suppressed(incident, rule) || r.paused(incident, rule) {
+		return nil
+	}
 	var rem *models.Remediation
 	switch incident.Type {
 	case "ACTIVE":
@@ -275,6 +583,114 @@ func (r *Remediator) processIncident(incident executor.Incident) *models.Remedia
 	return rem
 }
 
+// maintenanceTarget returns the devices and sites an incident, or the components of an
+// aggregate incident, are about
+func maintenanceTarget(incident executor.Incident, rule Rule) maintenance.Target {
+	t := maintenance.Target{Rule: rule.AlertName}
+	data := []map[string]interface{}{incident.Data}
+	if components, ok := incident.Data["components"].([]map[string]interface{}); ok && incident.IsAggregate {
+		data = components
+	}
+	for _, d := range data {
+		if device, ok := d["device"]; ok {
+			t.Devices = append(t.Devices, fmt.Sprintf("%v", device))
+		}
+		if site, ok := d["site"]; ok {
+			t.Sites = append(t.Sites, fmt.Sprintf("%v", site))
+		}
+	}
+	return t
+}
+
+// suppressed returns true if the incident is in a maintenance window, recording why it
+// is not acted on. Only active incidents are suppressed, cleared ones are processed so
+// that remediations made before the window are cleaned up.
+func (r *Remediator) suppressed(incident executor.Incident, rule Rule) bool {
+	if incident.Type != "ACTIVE" {
+		return false
+	}
+	w, ok := r.maintenance.Check(maintenanceTarget(incident, rule), time.Now())
+	if !ok {
+		return false
+	}
+	r.suppress(incident, w.Name, w.String())
+	return true
+}
+
+// suppress records that the incident is not acted on and why
+func (r *Remediator) suppress(incident executor.Incident, window, reason string) {
+	glog.Infof("Suppressing incident %s:%d: %s", incident.Name, incident.Id, reason)
+	if _, err := r.Db.NewRecord(models.NewSuppression(incident, window, reason)); err != nil {
+		glog.Errorf("Failed to record suppression of incident %d: %v", incident.Id, err)
+	}
+}
+
+// paused returns true if the rule is paused, pausing it first if the incident is one too
+// many within the storm detection window of the rule. Active incidents of paused rules are
+// recorded as suppressed, cleared ones are processed so that remediations made before the
+// storm are cleaned up.
+func (r *Remediator) paused(incident executor.Incident, rule Rule) bool {
+	if incident.Type != "ACTIVE" {
+		return false
+	}
+	storm := rule.Storm
+	if storm == nil {
+		storm = r.Config.Config.Storm
+	}
+	desc := fmt.Sprintf("%d:%s %v", incident.Id, incident.Name, incident.Entities())
+	if incidents := r.limits.incident(rule.AlertName, incident.Id, desc, storm, time.Now()); incidents != nil {
+		reason, _ := r.limits.pausedReason(rule.AlertName)
+		if err := r.Db.PauseRule(models.NewPausedRule(rule.AlertName, reason)); err != nil {
+			glog.Errorf("Failed to record paused rule %s: %v", rule.AlertName, err)
+		}
+		r.escalateStorm(rule, incidents)
+	}
+	reason, ok := r.limits.pausedReason(rule.AlertName)
+	if !ok {
+		return false
+	}
+	r.suppress(incident, "", reason)
+	return true
+}
+
+// escalateStorm opens a task summarising the incident storm that paused rule. Storms are
+// escalated even if the rule does not escalate its incidents.
+func (r *Remediator) escalateStorm(rule Rule, incidents []string) {
+	reason, _ := r.limits.pausedReason(rule.AlertName)
+	glog.Errorf("%s, re-enable it with POST /admin/rules/%s/enable", reason, rule.AlertName)
+	if r.esc == nil {
+		return
+	}
+	t := &escalate.Task{}
+	t.Title = fmt.Sprintf("Incident storm: %s paused", rule.AlertName)
+	t.Params = map[string]string{"project": rule.JiraProject}
+	if err := r.esc.CreateTask(t); err != nil {
+		glog.Errorf("Failed to open task: %v", err)
+		return
+	}
+	t.Params = map[string]string{"description": fmt.Sprintf(
+		"%s. No incidents of the rule are acted on until it is re-enabled with POST /admin/rules/%s/enable\n\nIncidents:\n%s",
+		reason, rule.AlertName, strings.Join(incidents, "\n"))}
+	if err := r.esc.UpdateTask(t); err != nil {
+		glog.Errorf("Failed to update task %s: %v", t.ID, err)
+	}
+}
+
+// EnableRule re-enables a rule that was paused after an incident storm
+func (r *Remediator) EnableRule(name string) error {
+	if _, ok := r.limits.pausedReason(name); !ok {
+		return fmt.Errorf("Rule %s is not paused", name)
+	}
+	if err := r.Db.ResumeRule(name); err != nil {
+		return fmt.Errorf("Failed to re-enable rule %s: %v", name, err)
+	}
+	if !r.limits.resume(name) {
+		return fmt.Errorf("Rule %s is not paused", name)
+	}
+	glog.Infof("Rule %s re-enabled", name)
+	return nil
+}
+
 func (r *Remediator) remediationForIncident(incident executor.Incident) *models.Remediation {
 	rem := models.NewRemediation(incident)
 	existing, err := r.Db.GetRemediations(models.QueryRemByIncidentId, rem.IncidentId)
@@ -330,6 +746,10 @@ func (r *Remediator) checkExisting(incident executor.Incident, rule Rule) (*mode
 		// TODO Provide a way to re-run the remediation if required (from task ?)
 		return current, true
 	}
+	if current.Status == models.Status_ROLLBACK_FAILED {
+		glog.Errorf("Rollback of remediation %d failed, not retrying incident %d", current.Id, incident.Id)
+		return current, true
+	}
 	if current.Status.IsFailed() {
 		if current.Attempts < rule.Attempts {
 			return current, false
@@ -339,6 +759,9 @@ func (r *Remediator) checkExisting(incident executor.Incident, rule Rule) (*mode
 	return current, true
 }
 
+// processActive remediates the incident and then verifies the remediation if it succeeded
+// in this run. The incident is no longer marked active while it is verified, so that it
+// is processed if it clears in the meantime.
 func (r *Remediator) processActive(incident executor.Incident, rule Rule) *models.Remediation {
 	// check if an existing remediation has taken place for the incident
 	rem, done := r.checkExisting(incident, rule)
@@ -348,6 +771,16 @@ func (r *Remediator) processActive(incident executor.Incident, rule Rule) *model
 		r.addTaskComment(&escalate.Task{ID: rem.TaskId}, comment)
 		return rem
 	}
+	rem = r.remediate(incident, rule, rem)
+	if rem != nil && rem.Status == models.Status_REMEDIATION_SUCCESS && rule.Verify != nil {
+		r.verify(rem, incident, rule)
+	}
+	return rem
+}
+
+// remediate runs the audits and remediations of rule for the incident, as a new attempt of
+// rem if it is not nil
+func (r *Remediator) remediate(incident executor.Incident, rule Rule, rem *models.Remediation) *models.Remediation {
 	if rem == nil {
 		rem = models.NewRemediation(incident)
 	}
@@ -371,6 +804,7 @@ func (r *Remediator) processActive(incident executor.Incident, rule Rule) *model
 		glog.Infof("Created new remediation %d for incident %d", newId, incident.Id)
 		rem.Id = newId
 	}
+	defer r.closeLogs(rem.Id)
 	// if an existing failed remediation/task exists, try another attempt. Else, create a new task
 	rem.Attempts += 1
 	task := &escalate.Task{}
@@ -387,29 +821,280 @@ func (r *Remediator) processActive(incident executor.Incident, rule Rule) *model
 		}
 	}()
 	// run pre-audits
-	cmds := getCmds(incident, rule.Audits)
+	cmds := getCmds(incident, rule, rule.Audits)
 	auditExeResults, passed := r.execute(rem, "audit", cmds)
 	if !passed {
 		glog.Errorf("Audit run failed, not running remediations")
-		r.notify(rem, "Audit run failed, not running remediations")
+		r.notifyResults(rem, "Audit run failed, not running remediations", auditExeResults)
 		r.updateTask(task, incident, auditExeResults, rem.TaskId == "")
 		return rem
 	}
+	dryRun := r.dryRun(rule)
+	if rule.RequireApproval && !dryRun {
+		if !r.awaitApproval(context.Background(), rem, incident, rule, task, "the remediations") {
+			rem.End(rem.Status, r.Db)
+			r.updateTask(task, incident, auditExeResults, rem.TaskId == "")
+			return rem
+		}
+	}
+	if !dryRun {
+		if err := r.limits.allow(rule.AlertName, config.RateLimit, rule.RateLimit, time.Now()); err != nil {
+			glog.Errorf("Not running remediations for incident %d: %v", incident.Id, err)
+			// the remediations did not run, so this does not count as an attempt
+			rem.Attempts -= 1
+			rem.End(models.Status_RATE_LIMITED, r.Db)
+			r.notifyResults(rem, fmt.Sprintf("Not running remediations: %v", err), auditExeResults)
+			r.updateTask(task, incident, auditExeResults, rem.TaskId == "")
+			return rem
+		}
+	}
 	// run remediations
-	cmds = getCmds(incident, rule.Remediations)
-	remExeResults, passed := r.execute(rem, "remediation", cmds)
-	if !passed {
-		glog.Errorf("Remediation run failed")
-		r.notify(rem, "Remediation run failed")
+	cmds = getCmds(incident, rule, rule.Remediations)
+	if !rule.RequireApproval {
+		r.setApproval(cmds, rem, incident, rule, task)
 	} else {
+		for i := range cmds {
+			cmds[i].RequireApproval = false
+		}
+	}
+	var plan string
+	if dryRun {
+		plan = setDryRun(cmds)
+	}
+	remExeResults, succeeded, failed := r.runCmds(rem, "remediation", cmds)
+	switch {
+	case !r.endFailed(rem, "remediation", failed):
+		glog.Errorf("Remediation run failed")
+		r.notifyResults(rem, "Remediation run failed", remExeResults)
+		if !dryRun {
+			remExeResults = append(remExeResults, r.rollback(rem, incident, rule, succeeded, task)...)
+		}
+	case dryRun:
+		rem.End(models.Status_DRY_RUN, r.Db)
+		r.notifyResults(rem, "Dry run, remediation would have run:\n"+plan, remExeResults)
+	default:
 		rem.End(models.Status_REMEDIATION_SUCCESS, r.Db)
-		r.notify(rem, "Remediation Successful")
+		r.notifyResults(rem, "Remediation Successful", remExeResults)
 		r.am.PostAck(incident.Id)
 	}
 	r.updateTask(task, incident, append(auditExeResults, remExeResults...), rem.TaskId == "")
 	return rem
 }
 
+type approval struct {
+	approved bool
+	user     string
+}
+
+// Approve approves or rejects remediation id, if it is waiting for approval, on behalf of user
+func (r *Remediator) Approve(id int64, user string, approved bool) error {
+	r.Lock()
+	defer r.Unlock()
+	ch, ok := r.approvals[id]
+	if !ok {
+		return fmt.Errorf("Remediation %d is not waiting for approval", id)
+	}
+	select {
+	case ch <- approval{approved: approved, user: user}:
+		return nil
+	default:
+		return fmt.Errorf("Remediation %d has already been approved or rejected", id)
+	}
+}
+
+// awaitApproval pauses the remediation until a user approves or rejects running what, or
+// the approval times out. The remediation is left with the status of the outcome.
+func (r *Remediator) awaitApproval(ctx context.Context, rem *models.Remediation, incident executor.Incident, rule Rule, task *escalate.Task, what string) bool {
+	ch := make(chan approval, 1)
+	r.Lock()
+	if r.approvals == nil {
+		r.approvals = make(map[int64]chan approval)
+	}
+	r.approvals[rem.Id] = ch
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		delete(r.approvals, rem.Id)
+		r.Unlock()
+	}()
+	timeout := rule.ApprovalTimeout
+	if timeout == 0 {
+		timeout = defaultApprovalTimeout
+	}
+	rem.Status = models.Status_WAITING_APPROVAL
+	if err := r.Db.UpdateRecord(rem); err != nil {
+		glog.Errorf("Failed to update rem in db: %v", err)
+	}
+	msg := fmt.Sprintf("Approval required to run %s for incident %d, approve or reject within %v with POST /api/remediations/%d/approve or /api/remediations/%d/reject",
+		what, incident.Id, timeout, rem.Id, rem.Id)
+	glog.Infof("Remediation %d is waiting for approval", rem.Id)
+	r.notify(rem, msg)
+	if r.esc != nil && task.ID != "" {
+		r.addTaskComment(task, msg)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case a := <-ch:
+		rem.Approver = a.user
+		if !a.approved {
+			rem.Status = models.Status_APPROVAL_REJECTED
+			r.notify(rem, fmt.Sprintf("Remediation rejected by %s", a.user))
+			return false
+		}
+		glog.Infof("Remediation %d approved by %s", rem.Id, a.user)
+		rem.Status = models.Status_ACTIVE
+		if err := r.Db.UpdateRecord(rem); err != nil {
+			glog.Errorf("Failed to update rem in db: %v", err)
+		}
+		r.notify(rem, fmt.Sprintf("Remediation approved by %s", a.user))
+		return true
+	case <-timer.C:
+		rem.Status = models.Status_APPROVAL_EXPIRED
+		r.notify(rem, fmt.Sprintf("Remediation was not approved within %v, aborting", timeout))
+	case <-ctx.Done():
+		rem.Status = models.Status_CANCELLED
+	}
+	return false
+}
+
+// setApproval lets the steps of cmds that require approval be approved. The first of them
+// to run asks for approval, which then holds for all of them.
+func (r *Remediator) setApproval(cmds []executor.Command, rem *models.Remediation, incident executor.Incident, rule Rule, task *escalate.Task) {
+	var (
+		once     sync.Once
+		approved bool
+	)
+	approve := func(ctx context.Context, cmd *executor.Command) error {
+		once.Do(func() {
+			approved = r.awaitApproval(ctx, rem, incident, rule, task, "step "+cmd.Name)
+		})
+		if !approved {
+			return fmt.Errorf("Step %s was not approved", cmd.Name)
+		}
+		return nil
+	}
+	for i := range cmds {
+		if cmds[i].RequireApproval {
+			cmds[i].Approval = approve
+		}
+	}
+}
+
+// rollbackCmds returns the undo commands of the remediation steps that succeeded in
+// reverse order, followed by the rollback commands of the rule. They run one at a time.
+func rollbackCmds(incident executor.Incident, rule Rule, succeeded []*executor.Command) []executor.Command {
+	var cmds []executor.Command
+	for i := len(succeeded) - 1; i >= 0; i-- {
+		for _, undo := range succeeded[i].Undo {
+			undo.Name = fmt.Sprintf("%s (undo %s)", undo.Name, succeeded[i].Name)
+			cmds = append(cmds, undo)
+		}
+	}
+	cmds = append(cmds, rule.Rollback...)
+	for i := range cmds {
+		cmds[i].DependsOn, cmds[i].Parallel = nil, false
+	}
+	return getCmds(incident, rule, cmds)
+}
+
+// rollback rolls back a failed remediation. If the rollback fails the device is left half
+// changed, so a task is opened even if the rule does not escalate.
+func (r *Remediator) rollback(rem *models.Remediation, incident executor.Incident, rule Rule, succeeded []*executor.Command, task *escalate.Task) models.Commands {
+	cmds := rollbackCmds(incident, rule, succeeded)
+	if len(cmds) == 0 {
+		return nil
+	}
+	glog.Infof("Rolling back remediation %d for incident %d", rem.Id, incident.Id)
+	results, _, failed := r.runCmds(rem, "rollback", cmds)
+	if failed == nil {
+		rem.End(models.Status_ROLLBACK_SUCCESS, r.Db)
+		r.notifyResults(rem, "Remediation rolled back", results)
+		return results
+	}
+	glog.Errorf("Rollback of remediation %d failed at %s", rem.Id, failed.Command.Name)
+	rem.End(models.Status_ROLLBACK_FAILED, r.Db)
+	msg := fmt.Sprintf("ROLLBACK FAILED at step %s, the remediation is partially applied and needs manual intervention", failed.Command.Name)
+	r.notifyResults(rem, msg, results)
+	if r.esc == nil {
+		return results
+	}
+	if task.ID == "" {
+		task.Title = fmt.Sprintf("Incident: %d:%s", incident.Id, incident.Name)
+		task.Params = map[string]string{"project": rule.JiraProject}
+		if err := r.esc.CreateTask(task); err != nil {
+			glog.Errorf("Failed to open task: %v", err)
+			return results
+		}
+	}
+	r.addTaskComment(task, msg)
+	return results
+}
+
+// verify checks that a successful remediation was effective and marks it as verified or
+// ineffective. The results of the verify commands are added to the task.
+func (r *Remediator) verify(rem *models.Remediation, incident executor.Incident, rule Rule) {
+	if !r.startVerify(rem.Id) {
+		glog.V(2).Infof("Remediation %d is already being verified, skipping", rem.Id)
+		return
+	}
+	defer r.endVerify(rem.Id)
+	defer r.closeLogs(rem.Id)
+	var (
+		results models.Commands
+		msg     string
+	)
+	verified := true
+	if wait := rule.Verify.WaitForClear; wait > 0 {
+		glog.V(2).Infof("Waiting %v for alert %d to clear", wait, incident.Id)
+		if !r.am.WaitOnStatus("CLEARED", incident.Id, r.Config.Config.AlertCheckInterval, wait) {
+			verified = false
+			msg = fmt.Sprintf("Remediation ineffective, alert did not clear within %v", wait)
+		}
+	}
+	if verified && len(rule.Verify.Commands) > 0 {
+		// failed verify commands dont fail the remediation, they only mark it ineffective
+		var failed *executor.CmdResult
+		results, _, failed = r.runCmds(rem, "verify", getCmds(incident, rule, rule.Verify.Commands))
+		if verified = failed == nil; !verified {
+			msg = "Remediation ineffective, verification failed"
+		}
+	}
+	if verified {
+		msg = "Remediation verified"
+	}
+	glog.V(2).Infof("%s for remediation %d", msg, rem.Id)
+	rem.Verified = &verified
+	// only the verified column is updated, the incident may have cleared meanwhile
+	if err := r.Db.SetVerified(rem.Id, verified); err != nil {
+		glog.Errorf("Failed to update rem in db: %v", err)
+	}
+	r.notifyResults(rem, msg, results)
+	if len(results) > 0 {
+		r.updateTask(&escalate.Task{ID: rem.TaskId}, incident, results, false)
+	}
+}
+
+// startVerify marks remediation id as being verified, returning false if it already is
+func (r *Remediator) startVerify(id int64) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.verifying[id] {
+		return false
+	}
+	if r.verifying == nil {
+		r.verifying = make(map[int64]bool)
+	}
+	r.verifying[id] = true
+	return true
+}
+
+func (r *Remediator) endVerify(id int64) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.verifying, id)
+}
+
 func (r *Remediator) processCleared(incident executor.Incident, rule Rule) *models.Remediation {
 	glog.V(2).Infof("Incident %d has now cleared", incident.Id)
 	rem := r.remediationForIncident(incident)
@@ -424,12 +1109,14 @@ func (r *Remediator) processCleared(incident executor.Incident, rule Rule) *mode
 	task := &escalate.Task{ID: rem.TaskId}
 	defer func() {
 		r.updateTask(task, incident, exeResults, false)
+		r.closeLogs(rem.Id)
 	}()
 	if len(rule.OnClear) == 0 {
 		glog.V(2).Infof("Nothing to do for incident %d clear", incident.Id)
 		return nil
 	}
-	if rem.Status != models.Status_REMEDIATION_SUCCESS {
+	dryRun := r.dryRun(rule)
+	if rem.Status != models.Status_REMEDIATION_SUCCESS && !(dryRun && rem.Status == models.Status_DRY_RUN) {
 		glog.V(2).Infof("Remediation %d for incident %d was not successful, skip onclear run", rem.Id, incident.Id)
 		return rem
 	}
@@ -441,11 +1128,19 @@ func (r *Remediator) processCleared(incident executor.Incident, rule Rule) *mode
 	glog.V(2).Infof("Incident %s is clear for %v, proceeding with onclear", incident.Name, rule.ClearCheckDuration)
 	// run on-clear
 	incident.Data["task_id"] = rem.TaskId
-	cmds := getCmds(incident, rule.OnClear)
+	cmds := getCmds(incident, rule, rule.OnClear)
+	var plan string
+	if dryRun {
+		plan = setDryRun(cmds)
+	}
 	exeResults, passed = r.execute(rem, "onclear", cmds)
-	if passed {
+	switch {
+	case passed && dryRun:
+		rem.End(models.Status_DRY_RUN, r.Db)
+		r.notifyResults(rem, "Dry run, on clear would have run:\n"+plan, exeResults)
+	case passed:
 		rem.End(models.Status_ONCLEAR_SUCCESS, r.Db)
-		r.notify(rem, "Incident cleared")
+		r.notifyResults(rem, "Incident cleared", exeResults)
 	}
 	return rem
 }
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	am "github.com/mayuresh82/auto_remediation/alert_manager"
 	"github.com/mayuresh82/auto_remediation/escalate"
 	"github.com/mayuresh82/auto_remediation/executor"
+	"github.com/mayuresh82/auto_remediation/maintenance"
 	"github.com/mayuresh82/auto_remediation/models"
 	"github.com/stretchr/testify/assert"
 )
@@ -31,18 +36,46 @@ func (q *MockQueue) Shutdown() error {
 
 type MockExecutor struct{}
 
-func (e *MockExecutor) Execute(ctx context.Context, cmds []executor.Command, maxParallel int) map[*executor.Command]*executor.CmdResult {
-	ret := make(map[*executor.Command]*executor.CmdResult)
-	for _, cmd := range cmds {
-		switch cmd.Name {
+func (e *MockExecutor) Execute(ctx context.Context, cmds []executor.Command, maxParallel int) []*executor.CmdResult {
+	var ret []*executor.CmdResult
+	for i := range cmds {
+		cmd := &cmds[i]
+		if cmd.RequireApproval && cmd.Approval != nil {
+			if err := cmd.Approval(ctx, cmd); err != nil {
+				ret = append(ret, &executor.CmdResult{Command: cmd, Error: err, Failure: executor.FailureRejected})
+				continue
+			}
+		}
+		// undo commands are named "<name> (undo <step>)"
+		switch strings.Fields(cmd.Name)[0] {
 		case "audit1":
-			ret[&cmd] = &executor.CmdResult{RetCode: 0, Error: nil}
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: 0, Error: nil})
 		case "audit2":
-			ret[&cmd] = &executor.CmdResult{RetCode: 1, Error: nil}
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: 1, Error: nil})
 		case "rem1":
-			ret[&cmd] = &executor.CmdResult{RetCode: 0, Error: nil}
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: 0, Error: nil})
 		case "rem2":
-			ret[&cmd] = &executor.CmdResult{RetCode: 1, Error: nil}
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: 1, Error: nil})
+		case "rem3":
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: -1, Error: fmt.Errorf("timed out"), Failure: executor.FailureTimeout})
+		case "rem5":
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: 1, Attempt: 1, Failure: executor.FailureExitNonZero})
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: 0, Attempt: 2})
+		case "rem6":
+			// only passes when dry run
+			res := &executor.CmdResult{Command: cmd}
+			if !cmd.DryRun {
+				res.RetCode = 1
+			}
+			ret = append(ret, res)
+		case "rem7":
+			ret = append(ret, &executor.CmdResult{Command: cmd, Artifacts: []executor.Artifact{{Name: "show/bgp.txt", Path: "rem7/show/bgp.txt", Size: 3}}})
+		case "rb1":
+			ret = append(ret, &executor.CmdResult{Command: cmd})
+		case "rb2":
+			ret = append(ret, &executor.CmdResult{Command: cmd, RetCode: 1, Failure: executor.FailureExitNonZero})
+		case "rem4":
+			ret = append(ret, &executor.CmdResult{Command: cmd, Error: fmt.Errorf("not found"), Failure: executor.FailureNotFound})
 		}
 	}
 	return ret
@@ -50,6 +83,8 @@ func (e *MockExecutor) Execute(ctx context.Context, cmds []executor.Command, max
 
 type MockDb struct {
 	getRemediations func() ([]*models.Remediation, error)
+	suppressions    []*models.Suppression
+	paused          map[string]string
 	*models.DB
 }
 
@@ -58,6 +93,9 @@ func (d MockDb) Close() error {
 }
 
 func (db *MockDb) NewRecord(i interface{}) (int64, error) {
+	if s, ok := i.(*models.Suppression); ok {
+		db.suppressions = append(db.suppressions, s)
+	}
 	return 1, nil
 }
 
@@ -65,6 +103,31 @@ func (db *MockDb) UpdateRecord(i interface{}) error {
 	return nil
 }
 
+func (db *MockDb) SetVerified(id int64, verified bool) error {
+	return nil
+}
+
+func (db *MockDb) PauseRule(p *models.PausedRule) error {
+	if db.paused == nil {
+		db.paused = make(map[string]string)
+	}
+	db.paused[p.Rule] = p.Reason
+	return nil
+}
+
+func (db *MockDb) ResumeRule(rule string) error {
+	delete(db.paused, rule)
+	return nil
+}
+
+func (db *MockDb) PausedRules() ([]*models.PausedRule, error) {
+	var paused []*models.PausedRule
+	for rule, reason := range db.paused {
+		paused = append(paused, &models.PausedRule{Rule: rule, Reason: reason})
+	}
+	return paused, nil
+}
+
 func (db *MockDb) GetRemediations(query string, args ...interface{}) ([]*models.Remediation, error) {
 	if db.getRemediations != nil {
 		return db.getRemediations()
@@ -98,6 +161,31 @@ var cmds = map[string][]executor.Command{
 	"remediations_failed": []executor.Command{
 		executor.Command{Name: "rem2", Command: "cmd2", Args: []string{"arg1", "arg2"}},
 	},
+	"remediations_timeout": []executor.Command{
+		executor.Command{Name: "rem3", Command: "cmd3"},
+	},
+	"remediations_not_found": []executor.Command{
+		executor.Command{Name: "rem4", Command: "cmd4"},
+	},
+	"remediations_retried": []executor.Command{
+		executor.Command{Name: "rem5", Command: "cmd5", Retries: 1},
+	},
+	"remediations_artifacts": []executor.Command{
+		executor.Command{Name: "rem7", Command: "cmd7"},
+	},
+	"remediations_dry_run": []executor.Command{
+		executor.Command{Name: "rem6", Command: "cmd6"},
+	},
+	"remediations_undo": []executor.Command{
+		executor.Command{Name: "rem1", Command: "cmd1", Undo: []executor.Command{{Name: "rb1", Command: "undo1"}}},
+		executor.Command{Name: "rem2", Command: "cmd2"},
+	},
+	"rollback_pass": []executor.Command{
+		executor.Command{Name: "rb1", Command: "rollback1"},
+	},
+	"rollback_failed": []executor.Command{
+		executor.Command{Name: "rb2", Command: "rollback2"},
+	},
 	"onclear": []executor.Command{
 		executor.Command{Name: "onclear1", Command: "cmd3", Args: []string{"arg1", "arg2"}},
 	},
@@ -110,9 +198,12 @@ func (m *MockNotifier) Send(rem *models.Remediation, msg string) error {
 }
 
 type MockEscalator struct {
+	attached []string
+	created  []string
 }
 
 func (m *MockEscalator) CreateTask(t *escalate.Task) error {
+	m.created = append(m.created, t.Title)
 	t.ID = "TASK-99"
 	return nil
 }
@@ -121,6 +212,11 @@ func (m *MockEscalator) UpdateTask(task *escalate.Task) error {
 	return nil
 }
 
+func (m *MockEscalator) AttachFile(task *escalate.Task, name string, r io.Reader) error {
+	m.attached = append(m.attached, name)
+	return nil
+}
+
 func (m *MockEscalator) LoadTask(t *escalate.Task) error {
 	t.Status = escalate.TaskStatusOpen
 	n := time.Now()
@@ -144,6 +240,16 @@ func TestIncidentProcessing(t *testing.T) {
 			Rule{AlertName: "Test3", Attempts: 2, Enabled: true, Audits: cmds["audits_failed"], Remediations: cmds["remediations_passed"]},
 			Rule{AlertName: "Test4", Attempts: 2, Enabled: true, Audits: cmds["audits_passed"], Remediations: cmds["remediations_failed"]},
 			Rule{AlertName: "Test5", Attempts: 3, Enabled: true, Audits: cmds["audits_passed"], Remediations: cmds["remediations_passed"]},
+			Rule{AlertName: "Test7", Attempts: 2, Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_timeout"]},
+			Rule{AlertName: "Test8", Attempts: 2, Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_not_found"]},
+			Rule{AlertName: "Test9", Attempts: 2, Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_retried"]},
+			Rule{AlertName: "Test10", Attempts: 2, Enabled: true, DryRun: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_dry_run"]},
+			Rule{AlertName: "Test12", Attempts: 2, Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"],
+				Verify: &Verify{Commands: cmds["audits_pass"]}},
+			Rule{AlertName: "Test13", Attempts: 2, Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"],
+				Verify: &Verify{Commands: cmds["audits_failed"]}},
+			Rule{AlertName: "Test14", Attempts: 2, Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"],
+				Verify: &Verify{WaitForClear: 10 * time.Millisecond, Commands: cmds["audits_pass"]}},
 		},
 	}
 	db := &MockDb{}
@@ -221,6 +327,15 @@ func TestIncidentProcessing(t *testing.T) {
 	assert.Equal(t, rem.Id, int64(200))
 	assert.Equal(t, rem.Status, models.Status_AUDIT_FAILED)
 
+	// remediations whose rollback failed are not retried
+	db.getRemediations = func() ([]*models.Remediation, error) {
+		return []*models.Remediation{&models.Remediation{Id: 400, Attempts: 1, Status: models.Status_ROLLBACK_FAILED}}, nil
+	}
+	inc.Id = 56
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Id, int64(400))
+	assert.Equal(t, rem.Status, models.Status_ROLLBACK_FAILED)
+
 	db.getRemediations = func() ([]*models.Remediation, error) { return []*models.Remediation{}, nil }
 	// test failed audit
 	inc.Name = "Test3"
@@ -235,9 +350,61 @@ func TestIncidentProcessing(t *testing.T) {
 	assert.Equal(t, rem.Id, int64(1))
 	assert.Equal(t, rem.Status, models.Status_REMEDIATION_FAILED)
 
+	// test failure classes
+	inc.Name = "Test7"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_TIMED_OUT)
+	assert.True(t, rem.Status.IsFailed())
+	inc.Name = "Test8"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_ERROR)
+
+	// test step that passed on retry
+	inc.Name = "Test9"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+
+	// test dry run
+	inc.Name = "Test10"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_DRY_RUN)
+	assert.False(t, rem.Status.IsFailed())
+
+	// test verification
+	inc.Name = "Test12"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.True(t, *rem.Verified)
+	inc.Name = "Test13"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.False(t, *rem.Verified)
+	// the alert never clears
+	inc.Name = "Test14"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.False(t, *rem.Verified)
+	// a remediation is verified only once at a time
+	r.startVerify(1)
+	inc.Name = "Test12"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.Nil(t, rem.Verified)
+	r.endVerify(1)
+	// re-fired incidents of successful remediations are not verified again
+	db.getRemediations = func() ([]*models.Remediation, error) {
+		return []*models.Remediation{&models.Remediation{Id: 100, Attempts: 1, Status: models.Status_REMEDIATION_SUCCESS}}, nil
+	}
+	inc.Name = "Test13"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Id, int64(100))
+	assert.Nil(t, rem.Verified)
+	db.getRemediations = func() ([]*models.Remediation, error) { return []*models.Remediation{}, nil }
+
 	// test success
 	inc.Name = "Test1"
 	rem = r.processIncident(inc)
+	assert.Nil(t, rem.Verified)
 	assert.Equal(t, rem.Id, int64(1))
 	assert.ElementsMatch(t, rem.Entities, []string{"d1:e1"})
 	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
@@ -259,11 +426,25 @@ func TestIncidentEscalate(t *testing.T) {
 		Rules: []Rule{
 			Rule{AlertName: "Test4", Enabled: true, Audits: cmds["audits_passed"], Remediations: cmds["remediations_failed"]},
 			Rule{AlertName: "Test3", Enabled: true, DontEscalate: true, Audits: cmds["audits_passed"], Remediations: cmds["remediations_passed"]},
+			Rule{AlertName: "Test11", Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_artifacts"]},
+			Rule{AlertName: "Test15", Enabled: true, DontEscalate: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_undo"],
+				Rollback: cmds["rollback_pass"]},
+			Rule{AlertName: "Test16", Enabled: true, DontEscalate: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_undo"],
+				Rollback: cmds["rollback_failed"]},
 		},
 	}
+	c.Config.JiraAttachArtifacts = true
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "rem7", "show"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "rem7", "show", "bgp.txt"), []byte("bgp"), 0644)
 	mockEsc := &MockEscalator{}
 	r := &Remediator{
 		Config:          c,
+		Artifacts:       executor.NewArtifactStore(dir),
 		Db:              &MockDb{},
 		queue:           &MockQueue{},
 		executor:        &MockExecutor{},
@@ -292,4 +473,347 @@ func TestIncidentEscalate(t *testing.T) {
 	rem = r.processIncident(inc)
 	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
 	assert.Equal(t, rem.TaskId, "")
+
+	// test artifacts attached to the task
+	inc.Name = "Test11"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.Equal(t, mockEsc.attached, []string{"cmd7-show_bgp.txt"})
+
+	// test rollback of a failed remediation
+	inc.Name = "Test15"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_ROLLBACK_SUCCESS)
+	assert.True(t, rem.Status.IsFailed())
+	assert.Equal(t, rem.TaskId, "")
+
+	// a failed rollback is escalated even if the rule does not escalate
+	inc.Name = "Test16"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_ROLLBACK_FAILED)
+	assert.Equal(t, rem.TaskId, "TASK-99")
+}
+
+// clearingClient reports alerts as ACTIVE until cleared is set
+type clearingClient struct {
+	requests, cleared int32
+}
+
+func (c *clearingClient) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	body := []byte(`[{"status": "ACTIVE"}]`)
+	if atomic.LoadInt32(&c.cleared) == 1 {
+		body = []byte(`[{"status": "CLEARED"}]`)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBuffer(body))}, nil
+}
+
+func TestClearedWhileVerifying(t *testing.T) {
+	c := &ConfigHandler{
+		Rules: []Rule{
+			Rule{AlertName: "Test23", Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"],
+				Verify: &Verify{WaitForClear: 5 * time.Second}, OnClear: cmds["onclear"]},
+		},
+	}
+	c.Config.AlertCheckInterval = time.Millisecond
+	client := &clearingClient{}
+	db := &MockDb{}
+	r := &Remediator{
+		Config:          c,
+		Db:              db,
+		queue:           &MockQueue{},
+		executor:        &MockExecutor{},
+		notif:           &MockNotifier{},
+		esc:             &MockEscalator{},
+		am:              &am.AlertManager{Client: client},
+		exe:             make(map[int64]chan struct{}),
+		enabled:         true,
+		activeIncidents: make(map[int64]bool),
+	}
+	inc := executor.Incident{
+		Name: "Test23",
+		Id:   40,
+		Type: "ACTIVE",
+		Data: map[string]interface{}{"entity": "e1", "device": "d1"},
+	}
+	done := make(chan *models.Remediation)
+	go func() {
+		done <- r.processIncident(inc)
+	}()
+	// the first request checks that the alert is up, the next ones wait for it to clear
+	for atomic.LoadInt32(&client.requests) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&client.cleared, 1)
+	db.getRemediations = func() ([]*models.Remediation, error) {
+		return []*models.Remediation{{Id: 1, IncidentId: 40, Status: models.Status_REMEDIATION_SUCCESS, TaskId: "TASK1"}}, nil
+	}
+	cleared := executor.Incident{Name: "Test23", Id: 40, Type: "CLEARED", Data: map[string]interface{}{"entity": "e1", "device": "d1"}}
+	rem := r.processIncident(cleared)
+	assert.Equal(t, rem.Status, models.Status_ONCLEAR_SUCCESS)
+	rem = <-done
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.True(t, *rem.Verified)
+}
+
+func TestApproval(t *testing.T) {
+	c := &ConfigHandler{
+		Rules: []Rule{
+			Rule{AlertName: "Test17", Enabled: true, RequireApproval: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"]},
+			Rule{AlertName: "Test18", Enabled: true, Audits: cmds["audits_pass"], Remediations: []executor.Command{
+				{Name: "rem1", Command: "cmd1", RequireApproval: true},
+			}},
+			Rule{AlertName: "Test19", Enabled: true, RequireApproval: true, ApprovalTimeout: 10 * time.Millisecond,
+				Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"]},
+		},
+	}
+	r := &Remediator{
+		Config:          c,
+		Db:              &MockDb{},
+		queue:           &MockQueue{},
+		executor:        &MockExecutor{},
+		notif:           &MockNotifier{},
+		esc:             &MockEscalator{},
+		am:              &am.AlertManager{Client: &MockClient{}},
+		exe:             make(map[int64]chan struct{}),
+		enabled:         true,
+		activeIncidents: make(map[int64]bool),
+	}
+	inc := executor.Incident{
+		Name: "Test17",
+		Id:   20,
+		Type: "ACTIVE",
+		Data: map[string]interface{}{"entity": "e1", "device": "d1"},
+	}
+	assert.Error(t, r.Approve(1, "alice", true))
+	// approve or reject the remediation once it is waiting
+	decide := func(approved bool) {
+		go func() {
+			for r.Approve(1, "alice", approved) != nil {
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	decide(true)
+	rem := r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.Equal(t, rem.Approver, "alice")
+
+	inc.Name = "Test18"
+	decide(false)
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_APPROVAL_REJECTED)
+	assert.Equal(t, rem.Approver, "alice")
+
+	inc.Name = "Test19"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_APPROVAL_EXPIRED)
+	assert.Equal(t, rem.Approver, "")
+}
+
+func TestMaintenance(t *testing.T) {
+	c := &ConfigHandler{
+		Rules: []Rule{
+			Rule{AlertName: "Test20", Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"],
+				OnClear: cmds["onclear"]},
+		},
+	}
+	now := time.Now()
+	schedule, err := maintenance.NewSchedule(maintenance.Config{Windows: []maintenance.Window{
+		{Name: "Upgrades", Reason: "CHG-1234", Scope: maintenance.Scope{Devices: []string{"bb*"}}, From: now.Add(-time.Hour), To: now.Add(time.Hour)},
+		{Name: "DC move", Scope: maintenance.Scope{Sites: []string{"ams2"}}, From: now.Add(-time.Hour), To: now.Add(time.Hour)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &MockDb{}
+	r := &Remediator{
+		Config:          c,
+		Db:              db,
+		queue:           &MockQueue{},
+		executor:        &MockExecutor{},
+		notif:           &MockNotifier{},
+		esc:             &MockEscalator{},
+		am:              &am.AlertManager{Client: &MockClient{}},
+		exe:             make(map[int64]chan struct{}),
+		maintenance:     schedule,
+		enabled:         true,
+		activeIncidents: make(map[int64]bool),
+	}
+	inc := executor.Incident{
+		Name: "Test20",
+		Id:   21,
+		Type: "ACTIVE",
+		Data: map[string]interface{}{"entity": "e1", "device": "bb1", "site": "sjc1"},
+	}
+	assert.Nil(t, r.processIncident(inc))
+	assert.Equal(t, len(db.suppressions), 1)
+	assert.Equal(t, db.suppressions[0].IncidentId, int64(21))
+	assert.Equal(t, db.suppressions[0].Window, "Upgrades")
+	assert.Equal(t, db.suppressions[0].Reason, "In maintenance window Upgrades: CHG-1234")
+
+	// cleared incidents in a window still clean up remediations made before it
+	db.getRemediations = func() ([]*models.Remediation, error) {
+		return []*models.Remediation{{Id: 1, IncidentId: 210, Status: models.Status_REMEDIATION_SUCCESS, TaskId: "TASK1"}}, nil
+	}
+	cleared := executor.Incident{Name: "Test20", Id: 210, Type: "CLEARED", Data: inc.Data}
+	rem := r.processIncident(cleared)
+	assert.Equal(t, rem.Status, models.Status_ONCLEAR_SUCCESS)
+	assert.Equal(t, len(db.suppressions), 1)
+	db.getRemediations = nil
+
+	// aggregate incidents are suppressed if any of their components are in scope
+	target := maintenanceTarget(executor.Incident{IsAggregate: true, Data: map[string]interface{}{
+		"components": []map[string]interface{}{{"device": "dr1", "site": "sjc1"}, {"device": "dr2", "site": "ams2"}},
+	}}, c.Rules[0])
+	assert.Equal(t, target.Devices, []string{"dr1", "dr2"})
+	assert.Equal(t, target.Sites, []string{"sjc1", "ams2"})
+
+	inc.Data["device"] = "dr1"
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.Equal(t, len(db.suppressions), 1)
+}
+
+func TestLimits(t *testing.T) {
+	var l limiter
+	now := time.Now()
+	global := &RateLimit{Max: 3, Window: time.Minute}
+	assert.Nil(t, l.allow("r1", global, &RateLimit{Max: 2, Window: time.Minute}, now))
+	assert.Nil(t, l.allow("r1", global, &RateLimit{Max: 2, Window: time.Minute}, now))
+	err := l.allow("r1", global, &RateLimit{Max: 2, Window: time.Minute}, now)
+	assert.Equal(t, err.Error(), "Rate limit of 2 remediations per 1m0s reached for rule r1")
+	assert.Nil(t, l.allow("r2", global, nil, now))
+	err = l.allow("r2", global, nil, now)
+	assert.Equal(t, err.Error(), "Rate limit of 3 remediations per 1m0s reached for all rules")
+	// remediations are allowed again once the earlier ones are out of the window
+	assert.Nil(t, l.allow("r2", global, nil, now.Add(2*time.Minute)))
+
+	storm := &StormDetection{Max: 2, Window: time.Minute}
+	assert.Nil(t, l.incident("r1", 1, "1", storm, now))
+	assert.Nil(t, l.incident("r1", 2, "2", storm, now.Add(30*time.Second)))
+	assert.Nil(t, l.incident("r1", 3, "3", storm, now.Add(90*time.Second)))
+	// the second incident is out of the window by now
+	assert.Nil(t, l.incident("r1", 4, "4", storm, now.Add(100*time.Second)))
+	// re-fires of an incident are only counted once
+	assert.Nil(t, l.incident("r1", 3, "3", storm, now.Add(100*time.Second)))
+	assert.Equal(t, l.incident("r1", 5, "5", storm, now.Add(100*time.Second)), []string{"3", "4", "5"})
+	reason, ok := l.pausedReason("r1")
+	assert.True(t, ok)
+	assert.Equal(t, reason, "Rule r1 is paused after 3 incidents within 1m0s")
+	// a storm only pauses the rule once
+	assert.Nil(t, l.incident("r1", 6, "6", storm, now.Add(100*time.Second)))
+	assert.True(t, l.resume("r1"))
+	assert.False(t, l.resume("r1"))
+	_, ok = l.pausedReason("r1")
+	assert.False(t, ok)
+}
+
+func TestIncidentStorm(t *testing.T) {
+	c := &ConfigHandler{
+		Rules: []Rule{
+			Rule{AlertName: "Test21", Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"],
+				RateLimit: &RateLimit{Max: 1, Window: time.Hour}},
+			Rule{AlertName: "Test22", Enabled: true, Audits: cmds["audits_pass"], Remediations: cmds["remediations_pass"],
+				Storm: &StormDetection{Max: 2, Window: time.Hour}, OnClear: cmds["onclear"]},
+		},
+	}
+	db := &MockDb{}
+	esc := &MockEscalator{}
+	r := &Remediator{
+		Config:          c,
+		Db:              db,
+		queue:           &MockQueue{},
+		executor:        &MockExecutor{},
+		notif:           &MockNotifier{},
+		esc:             esc,
+		am:              &am.AlertManager{Client: &MockClient{}},
+		exe:             make(map[int64]chan struct{}),
+		enabled:         true,
+		activeIncidents: make(map[int64]bool),
+	}
+	inc := executor.Incident{
+		Name: "Test21",
+		Id:   30,
+		Type: "ACTIVE",
+		Data: map[string]interface{}{"entity": "e1", "device": "d1"},
+	}
+	rem := r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	inc.Id = 31
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_RATE_LIMITED)
+	// refused runs don't use up the attempts of the incident
+	assert.Equal(t, rem.Attempts, 0)
+
+	inc.Name = "Test22"
+	for id := int64(32); id < 34; id++ {
+		inc.Id = id
+		rem = r.processIncident(inc)
+		assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	}
+	// re-fires of remediated incidents are not counted towards the storm
+	db.getRemediations = func() ([]*models.Remediation, error) {
+		return []*models.Remediation{{Id: 1, IncidentId: 33, Status: models.Status_REMEDIATION_SUCCESS, TaskId: "TASK1"}}, nil
+	}
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+	assert.Empty(t, db.suppressions)
+	db.getRemediations = nil
+	esc.created = nil
+	// the third incident within the window pauses the rule and opens a single task
+	for id := int64(34); id < 36; id++ {
+		inc.Id = id
+		assert.Nil(t, r.processIncident(inc))
+	}
+	assert.Equal(t, esc.created, []string{"Incident storm: Test22 paused"})
+	assert.Equal(t, len(db.suppressions), 2)
+	assert.Equal(t, db.suppressions[1].IncidentId, int64(35))
+	assert.Equal(t, db.suppressions[1].Reason, "Rule Test22 is paused after 3 incidents within 1h0m0s")
+	assert.Equal(t, db.paused, map[string]string{"Test22": "Rule Test22 is paused after 3 incidents within 1h0m0s"})
+	// the rule stays paused after a restart
+	var restarted limiter
+	paused, _ := db.PausedRules()
+	restarted.restore(paused)
+	_, ok := restarted.pausedReason("Test22")
+	assert.True(t, ok)
+
+	// cleared incidents of a paused rule are not suppressed
+	db.getRemediations = func() ([]*models.Remediation, error) {
+		return []*models.Remediation{{Id: 1, IncidentId: 310, Status: models.Status_REMEDIATION_SUCCESS, TaskId: "TASK1"}}, nil
+	}
+	cleared := executor.Incident{Name: "Test22", Id: 310, Type: "CLEARED", Data: map[string]interface{}{"entity": "e1", "device": "d1"}}
+	rem = r.processIncident(cleared)
+	assert.Equal(t, rem.Status, models.Status_ONCLEAR_SUCCESS)
+	assert.Equal(t, len(db.suppressions), 2)
+	db.getRemediations = nil
+
+	assert.Nil(t, r.EnableRule("Test22"))
+	assert.Error(t, r.EnableRule("Test22"))
+	assert.Empty(t, db.paused)
+	inc.Id = 36
+	rem = r.processIncident(inc)
+	assert.Equal(t, rem.Status, models.Status_REMEDIATION_SUCCESS)
+}
+
+func TestRollbackCmds(t *testing.T) {
+	rule := Rule{
+		Remediations: []executor.Command{
+			{Name: "Drain", Undo: []executor.Command{{Name: "Undrain"}}},
+			{Name: "Bounce", Undo: []executor.Command{{Name: "Restore Config"}, {Name: "Clear Counters", Parallel: true}}},
+			{Name: "Verify"},
+		},
+		Rollback: []executor.Command{{Name: "Rollback Config", DependsOn: []string{"Verify"}}},
+	}
+	succeeded := []*executor.Command{&rule.Remediations[0], &rule.Remediations[1]}
+	cmds := rollbackCmds(executor.Incident{Name: "Test"}, rule, succeeded)
+	var names []string
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name)
+		assert.Nil(t, cmd.DependsOn)
+		assert.False(t, cmd.Parallel)
+		assert.Equal(t, cmd.Input.Name, "Test")
+	}
+	assert.Equal(t, names, []string{"Restore Config (undo Bounce)", "Clear Counters (undo Bounce)", "Undrain (undo Drain)", "Rollback Config"})
+	assert.Nil(t, executor.ValidateSteps(cmds))
 }
@@ -1,4 +1,6 @@
+import json
 import napalm
+import os
 import sys
 import requests
 import time
@@ -157,17 +159,50 @@ def run_awx_job(url, token, job_id, extra_vars, limit=None, timeout=90):
     return job_id, True
 
 
-def exit(out, passed):
-    out['passed'] = passed
-    txt = ''
-    for k, v in out.items():
-        txt += f'{k}: {v}\n\n'
-    print(txt)
+RESULT_VERSION = 1
+
+
+def result(passed, message='', data=None, severity=None, suggested_next=None):
+    """Builds the versioned result envelope understood by the executor."""
+    res = {
+        'version': RESULT_VERSION,
+        'passed': passed,
+        'message': message,
+        'data': data or {},
+    }
+    if severity:
+        res['severity'] = severity
+    if suggested_next:
+        res['suggested_next'] = suggested_next
+    return res
+
+
+def exit(out, passed, severity=None, suggested_next=None):
+    data = dict(out)
+    message = data.pop('message', '')
+    data.pop('passed', None)
+    print(json.dumps(result(passed, message, data, severity,
+                            suggested_next), default=str))
     if passed:
         sys.exit(0)
     sys.exit(1)
 
 
+def save_artifact(name, content):
+    """Saves content as a file named name in the artifacts dir of the command, which
+    the executor collects and stores with the command. Returns the path of the file,
+    or None if the command has no artifacts dir."""
+    base = os.environ.get('AR_ARTIFACTS_DIR')
+    if not base:
+        return None
+    path = os.path.join(base, name)
+    os.makedirs(os.path.dirname(path), exist_ok=True)
+    mode = 'wb' if isinstance(content, bytes) else 'w'
+    with open(path, mode) as f:
+        f.write(content)
+    return path
+
+
 def nb_device_ip(nb_url, device):
     url = nb_url + f'/api/dcim/devices/?name={device}'
     resp = requests.get(url)
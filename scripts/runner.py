@@ -11,6 +11,13 @@ import os
 import warnings
 warnings.filterwarnings('ignore')
 
+# version of the result envelope printed on stdout, see common.result()
+RESULT_VERSION = 1
+# exit code reported to the executor when the script does not exist
+EXIT_NOT_FOUND = 127
+# exit code reported to the executor when the scripts package cannot be imported
+EXIT_IMPORT_FAILED = 126
+
 
 def setup_logging(name, loglvl):
     logger = logging.getLogger(name)
@@ -56,12 +63,13 @@ def main(args):
         scriptClass = pkg.getScript(main_args.script_name)
     except Exception as ex:
         logger.error(ex)
-        print(json.dumps(
-            {'passed': False, 'message': 'Failed to import scripts pkg'}))
-        sys.exit(1)
+        print(json.dumps({'version': RESULT_VERSION, 'passed': False,
+                          'message': 'Failed to import scripts pkg'}))
+        sys.exit(EXIT_IMPORT_FAILED)
     if not scriptClass:
-        print(json.dumps({'passed': False, 'message': 'Script not found'}))
-        sys.exit(1)
+        print(json.dumps({'version': RESULT_VERSION,
+                          'passed': False, 'message': 'Script not found'}))
+        sys.exit(EXIT_NOT_FOUND)
     script = scriptClass(logger, common_opts)
     if main_args.test:
         data = script.test()
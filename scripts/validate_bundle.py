@@ -0,0 +1,27 @@
+#!/usr/bin/env python3
+"""Validates a scripts bundle before the executor activates it, by making sure that
+the runner and every script module in the bundle can be imported."""
+
+import importlib
+import os
+import sys
+
+
+def main():
+    path = os.path.abspath(os.environ.get(
+        'BUNDLE_PATH', os.path.dirname(__file__)))
+    pkg_path, pkg_name = os.path.split(path)
+    sys.path.insert(0, path)
+    sys.path.insert(0, pkg_path)
+    importlib.import_module('runner')
+    pkg = importlib.import_module(pkg_name)
+    for m in pkg.__modules__:
+        importlib.import_module(m)
+
+
+if __name__ == '__main__':
+    try:
+        main()
+    except Exception as ex:
+        print('Bundle validation failed: {}'.format(ex), file=sys.stderr)
+        sys.exit(1)
@@ -0,0 +1,257 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	TypeFile = "file"
+	TypeEnv  = "env"
+	TypeHTTP = "http"
+
+	defaultHTTPTimeout = 10 * time.Second
+)
+
+// Provider looks up the value of a secret by name
+type Provider interface {
+	Get(name string) (string, error)
+}
+
+// Config configures a secret provider
+type Config struct {
+	Type string
+	// Path and KeyFile are the encrypted store and the key of a file provider
+	Path    string
+	KeyFile string `yaml:"key_file"`
+	// Prefix is prepended to secret names to get the env var of an env provider
+	Prefix string
+	// URL, Token and Timeout configure an http provider
+	URL     string
+	Token   string
+	Timeout time.Duration
+}
+
+func NewProvider(c Config) (Provider, error) {
+	switch c.Type {
+	case TypeFile:
+		key, err := LoadKey(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &FileProvider{path: c.Path, key: key}, nil
+	case TypeEnv:
+		// the prefix tells the env vars that hold secrets from those that can be passed on
+		// to commands
+		if c.Prefix == "" {
+			return nil, fmt.Errorf("An env secret provider requires a prefix")
+		}
+		return &EnvProvider{prefix: c.Prefix}, nil
+	case TypeHTTP:
+		if c.URL == "" {
+			return nil, fmt.Errorf("An http secret provider requires a url")
+		}
+		timeout := c.Timeout
+		if timeout == 0 {
+			timeout = defaultHTTPTimeout
+		}
+		return &HTTPProvider{url: strings.TrimRight(c.URL, "/"), token: c.Token, client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, fmt.Errorf("Unknown secret provider type: %s", c.Type)
+}
+
+// Store resolves references to secrets of the form <provider>:<name> against the
+// configured providers
+type Store struct {
+	providers map[string]Provider
+}
+
+func NewStore(configs map[string]Config) (*Store, error) {
+	s := &Store{providers: make(map[string]Provider)}
+	for name, c := range configs {
+		p, err := NewProvider(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid secret provider %s: %v", name, err)
+		}
+		s.providers[name] = p
+	}
+	return s, nil
+}
+
+// IsSecretEnv returns true if the env var name holds a secret of an env provider
+func (s *Store) IsSecretEnv(name string) bool {
+	for _, p := range s.providers {
+		if ep, ok := p.(*EnvProvider); ok && ep.IsSecretEnv(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the value of the secret ref
+func (s *Store) Resolve(ref string) (string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid secret reference %s, expected <provider>:<name>", ref)
+	}
+	p, ok := s.providers[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("Unknown secret provider %s", parts[0])
+	}
+	val, err := p.Get(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("Failed to get secret %s: %v", ref, err)
+	}
+	return val, nil
+}
+
+// EnvProvider reads secrets from the env of the daemon
+type EnvProvider struct {
+	prefix string
+}
+
+func (p *EnvProvider) Get(name string) (string, error) {
+	val, ok := os.LookupEnv(p.prefix + name)
+	if !ok {
+		return "", fmt.Errorf("%s%s is not set", p.prefix, name)
+	}
+	return val, nil
+}
+
+// IsSecretEnv returns true if the env var name holds a secret of the provider
+func (p *EnvProvider) IsSecretEnv(name string) bool {
+	return strings.HasPrefix(name, p.prefix)
+}
+
+// FileProvider reads secrets from a YAML map of names to values encrypted with Encrypt.
+// The file is read on every lookup so that it can be updated without a restart.
+type FileProvider struct {
+	path string
+	key  []byte
+}
+
+func (p *FileProvider) Get(name string) (string, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return "", err
+	}
+	plain, err := Decrypt(data, p.key)
+	if err != nil {
+		return "", err
+	}
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(plain, &secrets); err != nil {
+		return "", fmt.Errorf("Invalid secrets file: %v", err)
+	}
+	val, ok := secrets[name]
+	if !ok {
+		return "", fmt.Errorf("Secret %s not found", name)
+	}
+	return val, nil
+}
+
+// HTTPProvider gets secrets from GET <url>/<name>, which returns {"value": "..."}
+type HTTPProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (p *HTTPProvider) Get(name string) (string, error) {
+	req, err := http.NewRequest("GET", p.url+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Got status %d", resp.StatusCode)
+	}
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("Invalid response: %v", err)
+	}
+	if body.Value == nil {
+		return "", fmt.Errorf("Response has no value")
+	}
+	return *body.Value, nil
+}
+
+// LoadKey reads a base64 encoded 32 byte AES key from path
+func LoadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read key: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Invalid key: expected 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// Encrypt encrypts plain with AES-GCM and returns it base64 encoded
+func Encrypt(plain, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Decrypt decrypts data encrypted with Encrypt
+func Decrypt(data, key []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secrets file: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid secrets file: too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt secrets: %v", err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,94 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	data, err := Encrypt([]byte("junos_password: s3cret\n"), key)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "s3cret")
+	ioutil.WriteFile(filepath.Join(dir, "secrets.enc"), data, 0600)
+
+	s, err := NewStore(map[string]Config{"vault": {Type: TypeFile, Path: filepath.Join(dir, "secrets.enc"), KeyFile: keyFile}})
+	assert.Nil(t, err)
+	val, err := s.Resolve("vault:junos_password")
+	assert.Nil(t, err)
+	assert.Equal(t, val, "s3cret")
+	_, err = s.Resolve("vault:missing")
+	assert.Error(t, err)
+	_, err = s.Resolve("junos_password")
+	assert.Error(t, err)
+	_, err = s.Resolve("other:junos_password")
+	assert.Error(t, err)
+
+	// the wrong key cannot decrypt the store
+	_, err = Decrypt(data, []byte("fedcba9876543210fedcba9876543210"))
+	assert.Error(t, err)
+	ioutil.WriteFile(keyFile, []byte("c2hvcnQ="), 0600)
+	_, err = NewStore(map[string]Config{"vault": {Type: TypeFile, KeyFile: keyFile}})
+	assert.Error(t, err)
+}
+
+func TestEnvProvider(t *testing.T) {
+	os.Setenv("AR_SECRET_api_token", "tok")
+	defer os.Unsetenv("AR_SECRET_api_token")
+	s, err := NewStore(map[string]Config{"env": {Type: TypeEnv, Prefix: "AR_SECRET_"}})
+	assert.Nil(t, err)
+	val, err := s.Resolve("env:api_token")
+	assert.Nil(t, err)
+	assert.Equal(t, val, "tok")
+	_, err = s.Resolve("env:missing")
+	assert.Error(t, err)
+	assert.True(t, s.IsSecretEnv("AR_SECRET_api_token"))
+	assert.False(t, s.IsSecretEnv("PATH"))
+	_, err = NewStore(map[string]Config{"env": {Type: TypeEnv}})
+	assert.Contains(t, err.Error(), "An env secret provider requires a prefix")
+}
+
+func TestHTTPProvider(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/secrets/junos/password" && r.URL.Path != "/secrets/junos%2Fpassword" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"value": "s3cret"}`)
+	}))
+	defer ts.Close()
+	s, err := NewStore(map[string]Config{
+		"http": {Type: TypeHTTP, URL: ts.URL + "/secrets/", Token: "tok"},
+		"anon": {Type: TypeHTTP, URL: ts.URL + "/secrets"},
+	})
+	assert.Nil(t, err)
+	val, err := s.Resolve("http:junos/password")
+	assert.Nil(t, err)
+	assert.Equal(t, val, "s3cret")
+	_, err = s.Resolve("http:missing")
+	assert.Error(t, err)
+	_, err = s.Resolve("anon:junos/password")
+	assert.Error(t, err)
+
+	_, err = NewStore(map[string]Config{"bad": {Type: "vault"}})
+	assert.Error(t, err)
+}